@@ -0,0 +1,103 @@
+package easytcp
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer picks the endpoint for every session of the client.
+// It's called concurrently by the sessions
+type Balancer interface {
+	// Pick returns the index of the chosen endpoint. The endpoints are never
+	// empty and must not be modified or kept after Pick returns
+	Pick(endpoints []*ClientEndpoint) int
+}
+
+// BalancerFunc is the function implementing the Balancer
+type BalancerFunc func(endpoints []*ClientEndpoint) int
+
+func (f BalancerFunc) Pick(endpoints []*ClientEndpoint) int {
+	return f(endpoints)
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobinBalancer returns the balancer picking the endpoints in turn.
+// It's the default one
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(endpoints []*ClientEndpoint) int {
+	return int((b.next.Add(1) - 1) % uint64(len(endpoints)))
+}
+
+type leastOutstandingBalancer struct {
+	next atomic.Uint64
+}
+
+// NewLeastOutstandingBalancer returns the balancer picking the endpoint with
+// the least amount of the outstanding sessions. The ties are broken in turn
+func NewLeastOutstandingBalancer() Balancer {
+	return &leastOutstandingBalancer{}
+}
+
+func (b *leastOutstandingBalancer) Pick(endpoints []*ClientEndpoint) int {
+	start := int((b.next.Add(1) - 1) % uint64(len(endpoints)))
+	best, least := start, endpoints[start].Outstanding()
+	for i := 1; i < len(endpoints) && least > 0; i++ {
+		j := (start + i) % len(endpoints)
+		if outstanding := endpoints[j].Outstanding(); outstanding < least {
+			best, least = j, outstanding
+		}
+	}
+	return best
+}
+
+type p2cBalancer struct{}
+
+// NewP2CBalancer returns the power of two choices balancer. It picks two random
+// endpoints and takes the one with less outstanding sessions, so it's almost as
+// good as the least outstanding one without looking at all the endpoints
+func NewP2CBalancer() Balancer {
+	return p2cBalancer{}
+}
+
+func (p2cBalancer) Pick(endpoints []*ClientEndpoint) int {
+	if len(endpoints) == 1 {
+		return 0
+	}
+	a := rand.Intn(len(endpoints))
+	b := rand.Intn(len(endpoints) - 1)
+	if b >= a {
+		b++
+	}
+	if endpoints[b].Outstanding() < endpoints[a].Outstanding() {
+		return b
+	}
+	return a
+}
+
+type weightedBalancer struct{}
+
+// NewWeightedBalancer returns the balancer picking the endpoints at random
+// in proportion to their weights
+func NewWeightedBalancer() Balancer {
+	return weightedBalancer{}
+}
+
+func (weightedBalancer) Pick(endpoints []*ClientEndpoint) int {
+	var total int64
+	for _, e := range endpoints {
+		total += int64(e.Weight())
+	}
+	n := rand.Int63n(total)
+	for i, e := range endpoints {
+		if n -= int64(e.Weight()); n < 0 {
+			return i
+		}
+	}
+	return len(endpoints) - 1
+}
@@ -0,0 +1,19 @@
+package easytcp
+
+import "github.com/Ghytro/easytcp/internal/connection"
+
+// WriteBatchConfig configures gathering of the small writes, which are
+// then sent with a single vectored write. Zero MaxSize disables it
+type WriteBatchConfig = connection.BatchConfig
+
+// Flush sends everything gathered by the write batching to the client at
+// once. It's done at the end of the handler chain anyway, so Flush is only
+// needed when the client should get the data before the chain completes.
+// In framed mode the response is a single frame sent once the chain
+// completes, so Flush does nothing
+func (ctx *ServerContext) Flush() error {
+	if ctx.frame != nil {
+		return nil
+	}
+	return ctx.conn.Flush()
+}
@@ -3,28 +3,170 @@ package easytcp
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Ghytro/easytcp/internal/common"
 	"github.com/Ghytro/easytcp/internal/connection"
 )
 
+// ErrClientClosed is returned from the sessions started after Client.Close
+var ErrClientClosed = connection.ErrPoolClosed
+
+// ErrPoolTimeout is matched by the *PoolTimeoutError
+// with errors.Is, so the wait duration is optional
+var ErrPoolTimeout = connection.ErrPoolTimeout
+
+// PoolTimeoutError is returned from WithSessionContext when its context is
+// done before the connection is available. It unwraps to the context error
+type PoolTimeoutError = connection.PoolTimeoutError
+
+// ErrPoolQueueFull is returned when more than MaxWaiters
+// sessions are already waiting for the connection
+var ErrPoolQueueFull = connection.ErrPoolQueueFull
+
+// ErrReconnecting is returned from the sessions failed fast while the
+// client is reconnecting to the server. It's joined with the last dial error
+var ErrReconnecting = connection.ErrReconnecting
+
+// ReconnectConfig configures reconnecting to the server once the dial fails.
+// The delay before every attempt is random up to the exponential backoff
+type ReconnectConfig = connection.ReconnectConfig
+
 type Client struct {
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	pool         *connection.Pool
+	ctx      context.Context
+	poolCfg  connection.PoolConfig
+	balancer Balancer
+	resolver Resolver
+
+	// replaced as a whole once changed, so the sessions pick without locking
+	endpoints   atomic.Pointer[[]*ClientEndpoint]
+	endpointsMu sync.Mutex
+
+	sharding ShardingConfig
+	// the endpoints of the keyed sessions, rebuilt with the endpoints
+	ring atomic.Pointer[hashRing]
+
+	// the removed endpoints being closed and the final counters of the
+	// closed ones, so the counters of Stats don't go back
+	statsMu sync.Mutex
+	removed map[*ClientEndpoint]struct{}
+	retired ClientStats
+
+	closed atomic.Bool
+	// stops resolving once the client is closed
+	done chan struct{}
 }
 
 type ClientConfig struct {
-	Address      string
+	// Address is the single server of the client. It's added
+	// to Endpoints if both of them are set
+	Address string
+
+	// Endpoints are the servers the sessions are balanced across.
+	// Every endpoint has its own pool of MaxConns connections
+	Endpoints []Endpoint
+
+	// Resolver returns the endpoints instead of Address and Endpoints.
+	// It's called once the client is created and then every ResolveInterval
+	Resolver Resolver
+
+	// ResolveInterval is the period of resolving the endpoints again. The
+	// new endpoints are added and the missing ones are removed once their
+	// active sessions complete. Zero means the endpoints are resolved once
+	ResolveInterval time.Duration
+
+	// Balancer picks the endpoint for every session.
+	// Defaults to the round-robin one
+	Balancer Balancer
+
+	// Sharding configures the endpoints of the keyed sessions
+	// started with WithKeySession. Balancer is not used for them
+	Sharding ShardingConfig
+
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	DialTimeout  time.Duration
 
+	// KeepOpenOnTimeout makes the expired read and write timeouts
+	// of the pooled connections return ErrTimeout and leave the
+	// connection usable. By default the connection is closed on timeout
+	KeepOpenOnTimeout bool
+
+	// MaxFrameSize limits the payload size of the frames read
+	// with IConnection.ReadFrame
+	MaxFrameSize int
+
+	// ReadBufferSize is the size of the read buffer of every
+	// pooled connection. Peek can't look further than that
+	ReadBufferSize int
+
+	// WriteBatch gathers the small writes of the pooled connections.
+	// The gathered writes are flushed with IConnection.Flush, before
+	// every blocking read and once the session is over
+	WriteBatch WriteBatchConfig
+
+	// Socket tunes the socket of every pooled connection
+	Socket SocketOptions
+
 	// MaxConns configurates maximum amount of connections
-	// in the pool. If zero or less is given, the amount
-	// of connections is unlimited
+	// in the pool of every endpoint. If zero or less is given, the amount
+	// of connections is unlimited. The connections are dialed
+	// once the sessions need them, so the dial errors are
+	// returned from the sessions
 	MaxConns int
+
+	// MinIdle is the amount of idle connections kept dialed in the
+	// background, so the sessions don't wait for the dial
+	MinIdle int
+
+	// MaxIdleTime is the time after which the idle connection is
+	// closed, unless it's one of MinIdle. Zero means no limit
+	MaxIdleTime time.Duration
+
+	// MaxLifetime is the time after which the connection is dialed
+	// again once it's idle, so the connections are rebalanced across
+	// the servers behind the address. Zero means no limit
+	MaxLifetime time.Duration
+
+	// MaxLifetimeJitter shortens the lifetime of every connection by the
+	// random amount up to it, so they are not rotated all at once.
+	// Defaults to the tenth of MaxLifetime
+	MaxLifetimeJitter time.Duration
+
+	// MaxWaiters limits the amount of sessions waiting for the connection
+	// while all of them are in use. The sessions over the limit fail with
+	// ErrPoolQueueFull at once. Zero means no limit
+	MaxWaiters int
+
+	// HealthCheck configures validation of the pooled connections
+	HealthCheck HealthCheckConfig
+
+	// Reconnect configures reconnecting in the background once the server
+	// is unreachable. The sessions either fail fast with ErrReconnecting
+	// or wait for the connection. Disabled by default
+	Reconnect ReconnectConfig
+}
+
+// HealthCheckConfig configures validation of the pooled connections. The
+// broken connections are closed and redialed before the next session
+type HealthCheckConfig struct {
+	// OnBorrow validates the connection before the session starts
+	OnBorrow bool
+
+	// OnReturn validates the connection once the session is over
+	OnReturn bool
+
+	// Interval is the period of validating the idle connections and
+	// redialing the broken ones. Zero disables the background checks
+	Interval time.Duration
+
+	// Ping validates the connection with the application request. By default
+	// the connection is only checked not to be closed by the server
+	Ping func(conn IConnection) error
 }
 
 // setDefault sets all the unset fields to default values
@@ -41,10 +183,14 @@ func (c *ClientConfig) setDefault() {
 	if c.MaxConns <= 0 {
 		c.MaxConns = DefaultClientConfig.MaxConns
 	}
+	if c.Balancer == nil {
+		c.Balancer = NewRoundRobinBalancer()
+	}
+	c.Sharding.setDefault()
 }
 
 func (c *ClientConfig) Validate() error {
-	if c.Address == "" {
+	if c.Address == "" && len(c.Endpoints) == 0 && c.Resolver == nil {
 		return common.WrapErr(errors.New("client config connection address is not set"))
 	}
 	return nil
@@ -62,35 +208,206 @@ func NewClient(ctx context.Context, cfg ClientConfig) (*Client, error) {
 		return nil, err
 	}
 	cfg.setDefault()
-	if cfg.Address == "" {
-		return nil, common.WrapErr(errors.New("client's remote address not specified"))
-	}
-	pool, err := connection.NewPool(ctx, cfg.Address, cfg.MaxConns, connection.ConnectionConfig{
-		ReadTimeout:  cfg.ReadTimeout,
-		WriteTimeout: cfg.WriteTimeout,
-		DialTimeout:  cfg.DialTimeout,
-	})
-	if err != nil {
-		return nil, err
+	var ping func(*connection.Connection) error
+	if cfg.HealthCheck.Ping != nil {
+		ping = func(conn *connection.Connection) error {
+			return cfg.HealthCheck.Ping(conn)
+		}
+	}
+	c := &Client{
+		ctx:      ctx,
+		balancer: cfg.Balancer,
+		sharding: cfg.Sharding,
+		resolver: cfg.Resolver,
+		done:     make(chan struct{}),
+		removed:  make(map[*ClientEndpoint]struct{}),
+		poolCfg: connection.PoolConfig{
+			Size:       cfg.MaxConns,
+			MaxWaiters: cfg.MaxWaiters,
+
+			MinIdle:           cfg.MinIdle,
+			MaxIdleTime:       cfg.MaxIdleTime,
+			MaxLifetime:       cfg.MaxLifetime,
+			MaxLifetimeJitter: cfg.MaxLifetimeJitter,
+
+			HealthCheck: connection.HealthCheckConfig{
+				OnBorrow: cfg.HealthCheck.OnBorrow,
+				OnReturn: cfg.HealthCheck.OnReturn,
+				Interval: cfg.HealthCheck.Interval,
+				Ping:     ping,
+			},
+			Reconnect: cfg.Reconnect,
+			Conn: connection.ConnectionConfig{
+				ReadTimeout:  cfg.ReadTimeout,
+				WriteTimeout: cfg.WriteTimeout,
+				DialTimeout:  cfg.DialTimeout,
+				MaxFrameSize: cfg.MaxFrameSize,
+
+				ReadBufferSize:    cfg.ReadBufferSize,
+				WriteBatch:        cfg.WriteBatch,
+				Socket:            cfg.Socket,
+				KeepOpenOnTimeout: cfg.KeepOpenOnTimeout,
+			},
+		},
 	}
-	return &Client{
-		readTimeout:  cfg.ReadTimeout,
-		writeTimeout: cfg.WriteTimeout,
-		pool:         pool,
-	}, nil
+	c.endpoints.Store(&[]*ClientEndpoint{})
+	c.rebuildRing()
+
+	if c.resolver != nil {
+		if err := c.resolve(ctx); err != nil {
+			c.Close(ctx)
+			return nil, err
+		}
+		if cfg.ResolveInterval > 0 {
+			go c.resolveLoop(cfg.ResolveInterval)
+		}
+		return c, nil
+	}
+	endpoints := cfg.Endpoints
+	if cfg.Address != "" {
+		endpoints = append([]Endpoint{{Address: cfg.Address}}, endpoints...)
+	}
+	for _, endpoint := range endpoints {
+		if err := c.AddEndpoint(endpoint); err != nil {
+			c.Close(ctx)
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
+// WithSession runs fn with the connection taken from the pool,
+// waiting for one while all of them are in use
 func (c *Client) WithSession(fn func(conn IConnection) error) error {
-	conn, err := c.pool.Acquire()
-	if err != nil {
-		return err
+	return c.WithSessionContext(context.Background(), fn)
+}
+
+// WithSessionContext is the same as WithSession, but waits for the connection
+// until ctx is done, then the *PoolTimeoutError is returned. The context
+// doesn't bound the session itself. If fn fails with the connection error,
+// such as io.EOF or the connection reset, the connection is discarded and
+// redialed before the next session
+func (c *Client) WithSessionContext(ctx context.Context, fn func(conn IConnection) error) error {
+	return c.session(ctx, c.pick, fn)
+}
+
+// session runs fn with the connection of the picked endpoint
+func (c *Client) session(
+	ctx context.Context,
+	pick func() (*ClientEndpoint, error),
+	fn func(conn IConnection) error,
+) (err error) {
+	var (
+		endpoint *ClientEndpoint
+		conn     *connection.Connection
+	)
+	for {
+		if endpoint, err = pick(); err != nil {
+			return err
+		}
+		endpoint.outstanding.Add(1)
+		conn, err = endpoint.pool.AcquireContext(ctx)
+		if err == nil {
+			break
+		}
+		endpoint.outstanding.Add(-1)
+		// the endpoint is removed after it was picked, so the next one is picked
+		if !errors.Is(err, connection.ErrPoolClosed) || c.closed.Load() {
+			return err
+		}
 	}
-	defer c.pool.Release(conn)
+	defer func() {
+		if connectionErr(err) {
+			endpoint.pool.Discard(conn)
+		} else {
+			endpoint.pool.Release(conn)
+		}
+		endpoint.outstanding.Add(-1)
+	}()
 	return fn(conn)
 }
 
+// connectionErr reports if the session failed because of the connection
+// itself, so it can't be reused. The timeouts leave the connection usable
+// if it keeps open on timeouts, otherwise it's closed already
+func connectionErr(err error) bool {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed):
+		return true
+	case errors.As(err, &netErr):
+		return !netErr.Timeout()
+	}
+	return false
+}
+
+// ClientStats is the snapshot of the connection pool metrics of the
+// client. The counters are cumulative over the client lifetime
+type ClientStats = connection.PoolStats
+
+// Stats returns the snapshot of the client metrics. The connections are
+// counted over the current endpoints, the counters include the removed
+// ones as well. It's cheap, so it can be polled often to export the metrics
+func (c *Client) Stats() ClientStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	total := c.retired
+	for _, e := range *c.endpoints.Load() {
+		stats := e.pool.Stats()
+		total.TotalConns += stats.TotalConns
+		total.IdleConns += stats.IdleConns
+		total.InUseConns += stats.InUseConns
+		addCounters(&total, stats)
+	}
+	for e := range c.removed {
+		addCounters(&total, e.pool.Stats())
+	}
+	return total
+}
+
+// addCounters adds the cumulative counters of stats to total
+func addCounters(total *ClientStats, stats ClientStats) {
+	total.WaitCount += stats.WaitCount
+	total.WaitDuration += stats.WaitDuration
+	total.Dials += stats.Dials
+	total.DialErrors += stats.DialErrors
+	total.Discarded += stats.Discarded
+	total.BytesRead += stats.BytesRead
+	total.BytesWritten += stats.BytesWritten
+}
+
+// Close stops starting the new sessions, waits for the active ones to complete
+// and closes all the connections. If ctx is done before, the connections of
+// the active sessions are closed while in use and the error of ctx is returned.
+// The later sessions and calls of Close return ErrClientClosed
+func (c *Client) Close(ctx context.Context) error {
+	c.endpointsMu.Lock()
+	if !c.closed.CompareAndSwap(false, true) {
+		c.endpointsMu.Unlock()
+		return ErrClientClosed
+	}
+	close(c.done)
+	endpoints := *c.endpoints.Load()
+	c.endpointsMu.Unlock()
+
+	var closeErr error
+	for _, e := range endpoints {
+		if err := e.pool.Close(ctx); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
 type IConnection interface {
 	connection.IConnectionMixin
 	connection.IConnectionReader
+	connection.IConnectionBufferedReader
 	connection.IConnectionWriter
+	connection.IConnectionHalfCloser
+	connection.IConnectionFramer
 }
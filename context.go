@@ -5,42 +5,74 @@ import (
 	"context"
 	"encoding"
 	"encoding/json"
-	"sync"
+	"errors"
+	"time"
 
+	"github.com/Ghytro/easytcp/internal/bufpool"
 	"github.com/Ghytro/easytcp/internal/common"
 	"github.com/Ghytro/easytcp/internal/connection"
+	"github.com/Ghytro/easytcp/internal/frame"
+	"github.com/Ghytro/easytcp/internal/sched"
 )
 
 // ServerContext provides high-level control over the tcp connection
 // with access to underlying context and storing connection-scoped
 // values. The underlying context is cancelled whenever the client
-// connection is closed
+// connection is closed or the server is shut down. While the message
+// is handled, the underlying context is the message context, which is
+// also bounded by the handler timeout
 type ServerContext struct {
 	ctx        context.Context
+	connCtx    context.Context
 	server     *Server
 	handlerIdx int
-	vals       map[string]interface{}
-	valMutex   *sync.Mutex
+	vals       *common.KVStore
+	msgVals    *common.KVStore
 	conn       *connection.Connection
 	resp       *bytes.Buffer
+
+	// callbacks registered with After during the current message
+	afterHooks []AfterHandler
+
+	// state of the protocol state machine, nil if the server has no state machine
+	state *connState
+
+	// queue of the connection in the worker pool, nil if the server has no worker pool
+	queue *sched.Queue
+
+	// messages sent with SendAsync
+	outbound *outbound
+
+	// request frame of the current message, nil if the server is not framed
+	frame    *frame.Frame
+	reqFrame frame.Frame
+	in       payloadReader
+
+	// reused context of the frames handled one by one
+	serial *ServerContext
+
+	// the connection was handed over to Proxy, which closes it once it's over
+	proxied bool
 }
 
+// AfterHandler is a callback registered with ServerContext.After. The error
+// is the one the handler chain finished with, or nil on success
+type AfterHandler func(ctx *ServerContext, err error)
+
 func (ctx *ServerContext) Context() context.Context {
 	return ctx.ctx
 }
 
+// Set stores the connection-scoped value by it's key. Consider
+// using Key for type-safe access to the values
 func (ctx *ServerContext) Set(key string, value interface{}) {
-	ctx.valMutex.Lock()
-	defer ctx.valMutex.Unlock()
-	ctx.vals[key] = value
+	ctx.vals.Set(key, value)
 }
 
 // Value retreives value from context by it's key. Returns val if the value is not present,
 // otherwise return nil
 func (ctx *ServerContext) Get(key string, val ...interface{}) interface{} {
-	ctx.valMutex.Lock()
-	defer ctx.valMutex.Unlock()
-	result, ok := ctx.vals[key]
+	result, ok := ctx.vals.Get(key)
 	if !ok {
 		if len(val) != 0 {
 			return val[0]
@@ -51,39 +83,313 @@ func (ctx *ServerContext) Get(key string, val ...interface{}) interface{} {
 }
 
 func (ctx *ServerContext) Delete(key string) {
-	ctx.valMutex.Lock()
-	defer ctx.valMutex.Unlock()
-	delete(ctx.vals, key)
+	ctx.vals.Delete(key)
+}
+
+// store returns the storage of the values of the given scope
+func (ctx *ServerContext) store(scope KeyScope) *common.KVStore {
+	if scope == ScopeMessage {
+		return ctx.msgVals
+	}
+	return ctx.vals
 }
 
 func (ctx *ServerContext) WriteBuf(b []byte) (int, error) {
 	return ctx.resp.Write(b)
 }
 
+// SendBuf sends everything written with WriteBuf to the client. In framed
+// mode the whole response is sent in a single frame once the handler chain
+// is completed, so SendBuf does nothing
 func (ctx *ServerContext) SendBuf() (int, error) {
+	if ctx.frame != nil {
+		return ctx.resp.Len(), nil
+	}
 	defer ctx.resp.Reset()
 	return ctx.SendBinary(ctx.resp.Bytes())
 
 }
 
+// Read reads the incoming data. In framed mode only the payload
+// of the current frame is read, then io.EOF is returned
 func (ctx *ServerContext) Read(b []byte) (int, error) {
-	return ctx.conn.Read(b)
+	return ctx.reader().Read(b)
 }
 
 func (ctx *ServerContext) WaitForPacket() error {
+	if ctx.frame != nil {
+		return nil
+	}
 	return ctx.conn.WaitForPacket()
 }
 
+// FrameID returns the id of the frame being handled. Returns zero
+// if the server is not framed
+func (ctx *ServerContext) FrameID() uint64 {
+	if ctx.frame == nil {
+		return 0
+	}
+	return ctx.frame.ID
+}
+
 func (ctx *ServerContext) Next() error {
-	if ctx.handlerIdx == len(ctx.server.handlers) {
+	handlers := ctx.server.handlers
+	switch {
+	case ctx.handlerIdx < len(handlers):
+		ctx.handlerIdx++
+		return handlers[ctx.handlerIdx-1](ctx)
+
+	// all the handlers are passed, so the message
+	// goes to the state machine if there is one
+	case ctx.handlerIdx == len(handlers) && ctx.state != nil:
+		ctx.handlerIdx++
+		return ctx.state.dispatch(ctx)
+	}
+	return nil
+}
+
+// State returns the current state of the connection in the server
+// state machine. Returns empty state if the server has no state machine
+func (ctx *ServerContext) State() State {
+	if ctx.state == nil {
+		return ""
+	}
+	return ctx.state.state()
+}
+
+// Transition moves the connection to another state of the server state machine.
+// The timeout of the new state starts counting from this moment
+func (ctx *ServerContext) Transition(to State) error {
+	if ctx.state == nil {
+		return common.WrapErr(errors.New("server has no state machine to make a transition"))
+	}
+	return ctx.state.transition(to)
+}
+
+// stateExpiredErr returns the state timeout error if the connection
+// was closed because of the state timeout, nil otherwise
+func (ctx *ServerContext) stateExpiredErr() error {
+	if ctx.state == nil {
 		return nil
 	}
-	ctx.handlerIdx++
-	return ctx.server.handlers[ctx.handlerIdx-1](ctx)
+	return ctx.state.expiredErr()
+}
+
+// After registers a callback that is called once the handler chain of the
+// current message has completed and the buffered response is sent. Callbacks
+// are called in reverse order of registration, the same way as deferred calls
+func (ctx *ServerContext) After(fn AfterHandler) {
+	ctx.afterHooks = append(ctx.afterHooks, fn)
+}
+
+func (ctx *ServerContext) runAfterHooks(err error) {
+	hooks := ctx.afterHooks
+	ctx.afterHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](ctx, err)
+	}
+}
+
+// runChain executes all the attached handlers from the first one
+func (ctx *ServerContext) runChain() error {
+	ctx.handlerIdx = 0
+	return ctx.Next()
+}
+
+// messageContext derives the context of a single message from the connection
+// context. It's bounded by the handler timeout and by the timeout given by
+// the client in the frame header, if the server propagates it
+func (ctx *ServerContext) messageContext(frameTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := ctx.server.handlerTimeout
+	if ctx.server.frameTimeouts && frameTimeout > 0 && (timeout <= 0 || frameTimeout < timeout) {
+		timeout = frameTimeout
+	}
+	// without the deadline the message doesn't need its own context
+	if timeout <= 0 {
+		return ctx.connCtx, func() {}
+	}
+	return context.WithTimeout(ctx.connCtx, timeout)
+}
+
+// withFrame fills msgCtx with the context of the message carried by the
+// frame. The message context shares connection-scoped values and the state
+// with the connection context, but has its own response. The response buffer
+// and the message values of msgCtx are reused. The returned cancel function
+// must be called once the message is handled
+func (ctx *ServerContext) withFrame(msgCtx *ServerContext, f frame.Frame) context.CancelFunc {
+	resp, msgVals := msgCtx.resp, msgCtx.msgVals
+	*msgCtx = *ctx
+	msgCtx.handlerIdx = 0
+	msgCtx.afterHooks = nil
+	msgCtx.serial = nil
+
+	if resp == nil {
+		resp = bufpool.GetBuffer()
+	}
+	resp.Reset()
+	msgCtx.resp = resp
+	if msgVals == nil {
+		msgVals = common.NewKVStore()
+	}
+	msgVals.Reset()
+	msgCtx.msgVals = msgVals
+
+	msgCtx.reqFrame = f
+	msgCtx.frame = &msgCtx.reqFrame
+	msgCtx.in = payloadReader{b: f.Payload}
+
+	var cancel context.CancelFunc
+	msgCtx.ctx, cancel = ctx.messageContext(f.Timeout)
+	return cancel
+}
+
+// serveFrame executes all the attached handlers for the message carried by the frame.
+// Returns the response frame, or false if nothing was sent during the handler chain.
+// The response payload is valid until the response buffer is reused
+func (ctx *ServerContext) serveFrame() (frame.Frame, bool, error) {
+	if err := ctx.runChain(); err != nil {
+		return frame.Frame{}, false, err
+	}
+	if ctx.resp.Len() == 0 {
+		return frame.Frame{}, false, nil
+	}
+	return frame.Frame{
+		ID:      ctx.frame.ID,
+		Payload: ctx.resp.Bytes(),
+	}, true, nil
 }
 
-// SendBinary send passed byte slice to client
+// frameErr handles the error returned from the handler chain of the frame. Returns
+// the error frame to reply with, false if there is none, or the error to close the
+// connection with
+func (ctx *ServerContext) frameErr(err error) (frame.Frame, bool, error) {
+	switch ctx.server.handleErr(ctx, err) {
+	case ErrActionContinue:
+		return frame.Frame{}, false, nil
+	case ErrActionReply:
+		wireErr, ok := wireError(err)
+		if !ok {
+			wireErr = NewError(CodeInternal, err.Error())
+		}
+		return wireErr.Frame(ctx.frame.ID), true, nil
+	}
+	return frame.Frame{}, false, &handledError{err: err}
+}
+
+// handleFrame reads the incoming frame, executes all the attached handlers
+// for it in the worker pool, sends the response frame and calls the After callbacks
+func (ctx *ServerContext) handleFrame() error {
+	f, err := ctx.conn.ReadFrame()
+	// the error frame is read along with the error, releasing
+	// the empty frame of the other errors does nothing
+	defer ctx.conn.ReleaseFrame(f)
+	if err != nil {
+		return err
+	}
+	if ctx.queue == nil {
+		return ctx.respondFrame(f)
+	}
+	var respErr error
+	if execErr := ctx.execute(func() { respErr = ctx.respondFrame(f) }); execErr != nil {
+		return execErr
+	}
+	return respErr
+}
+
+// respondFrame executes all the attached handlers for the frame,
+// sends the response frame and calls the After callbacks. The frames
+// are handled one by one, so the message context is reused
+func (ctx *ServerContext) respondFrame(f frame.Frame) error {
+	if ctx.serial == nil {
+		ctx.serial = new(ServerContext)
+	}
+	msgCtx := ctx.serial
+	cancel := ctx.withFrame(msgCtx, f)
+	defer cancel()
+	resp, ok, err := msgCtx.serveFrame()
+	msgErr := err
+	if err != nil {
+		resp, ok, err = msgCtx.frameErr(err)
+	}
+	if err == nil && ok {
+		err = ctx.conn.WriteFrame(resp)
+		if err == nil {
+			err = ctx.conn.Flush()
+		}
+		if msgErr == nil {
+			msgErr = err
+		}
+	}
+	msgCtx.runAfterHooks(msgErr)
+	return err
+}
+
+// executeMessage handles the incoming message in the worker pool
+func (ctx *ServerContext) executeMessage() error {
+	if ctx.queue == nil {
+		return ctx.handleMessage()
+	}
+	var err error
+	if execErr := ctx.execute(func() { err = ctx.handleMessage() }); execErr != nil {
+		return execErr
+	}
+	return err
+}
+
+// handleMessage executes all the attached handlers for the incoming
+// message, sends the buffered response and calls the After callbacks
+func (ctx *ServerContext) handleMessage() error {
+	var cancel context.CancelFunc
+	ctx.ctx, cancel = ctx.messageContext(0)
+	ctx.msgVals.Reset()
+	defer func() {
+		cancel()
+		ctx.ctx = ctx.connCtx
+	}()
+
+	if err := ctx.runChain(); err != nil {
+		ctx.runAfterHooks(err)
+
+		// the error cannot be replied without frames,
+		// so the connection is closed on ErrActionReply
+		if ctx.server.handleErr(ctx, err) == ErrActionContinue {
+			ctx.resp.Reset()
+			return ctx.conn.Flush()
+		}
+		return &handledError{err: err}
+	}
+
+	err := ctx.flushResponse()
+	if err == nil {
+		err = ctx.conn.Flush()
+	}
+	ctx.runAfterHooks(err)
+	return err
+}
+
+// flushResponse sends the response written with WriteBuf to socket
+func (ctx *ServerContext) flushResponse() error {
+	if ctx.resp.Len() == 0 {
+		return nil
+	}
+	respLen := ctx.resp.Len()
+	n, err := ctx.SendBuf()
+	if err != nil {
+		return common.WrapErr(common.NestedCloseConnErr(err, ctx.conn.Close()))
+	}
+	if n != respLen {
+		err := errors.New("not all the bytes were written to response, connection closed")
+		return common.WrapErr(common.NestedCloseConnErr(err, ctx.conn.Close()))
+	}
+	return nil
+}
+
+// SendBinary send passed byte slice to client. In framed mode
+// the data is appended to the response frame
 func (ctx *ServerContext) SendBinary(b []byte) (int, error) {
+	if ctx.frame != nil {
+		return ctx.resp.Write(b)
+	}
 	return ctx.conn.Write(b)
 }
 
@@ -115,7 +421,11 @@ func (ctx *ServerContext) Send(data interface{}) error {
 		b, err = t.MarshalBinary()
 
 	default:
-		b, err = json.Marshal(t)
+		buf := bufpool.GetBuffer()
+		defer bufpool.PutBuffer(buf)
+		err = json.NewEncoder(buf).Encode(t)
+		// unlike json.Marshal the encoder terminates the value with newline
+		b = bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
 	}
 	if err != nil {
 		return err
@@ -125,6 +435,26 @@ func (ctx *ServerContext) Send(data interface{}) error {
 	return err
 }
 
+// CloseWrite sends the pending writes and shuts down the writing side of the
+// connection, so the client reads io.EOF once it reads everything sent. The
+// client can still send the data. Can't be used in framed mode
+func (ctx *ServerContext) CloseWrite() error {
+	if ctx.server.framed {
+		return common.WrapErr(errors.New("half-close can't be used in framed mode"))
+	}
+	return ctx.conn.CloseWrite()
+}
+
+// CloseRead shuts down the reading side of the connection, the data already
+// buffered can still be read. The client can still be replied. Can't be
+// used in framed mode
+func (ctx *ServerContext) CloseRead() error {
+	if ctx.server.framed {
+		return common.WrapErr(errors.New("half-close can't be used in framed mode"))
+	}
+	return ctx.conn.CloseRead()
+}
+
 func (ctx *ServerContext) RemoteAddr() string {
 	return ctx.conn.RemoteAddr()
 }
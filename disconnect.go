@@ -0,0 +1,64 @@
+package easytcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// DisconnectReason explains why the client connection was closed
+type DisconnectReason int
+
+const (
+	// DisconnectClientClosed means that the client closed the connection by itself
+	DisconnectClientClosed DisconnectReason = iota
+
+	// DisconnectTimeout means that the client didn't manage to send or receive
+	// data in time, or was idle for too long
+	DisconnectTimeout
+
+	// DisconnectServerShutdown means that the context passed to Server.Listen is done
+	DisconnectServerShutdown
+
+	// DisconnectError means that the connection was closed because of the error
+	// returned from one of the handlers or occured in network
+	DisconnectError
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClientClosed:
+		return "client closed"
+	case DisconnectTimeout:
+		return "timeout"
+	case DisconnectServerShutdown:
+		return "server shutdown"
+	case DisconnectError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// DisconnectHandler is called once the client connection is closed.
+// The context of ServerContext is already cancelled at that moment,
+// but the connection-scoped values are still available
+type DisconnectHandler func(ctx *ServerContext, reason DisconnectReason)
+
+// disconnectReason guesses the reason of connection closing by the error
+// that caused it
+func disconnectReason(err error) DisconnectReason {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return DisconnectClientClosed
+
+	case errors.Is(err, ErrStateTimeout),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return DisconnectTimeout
+	}
+	return DisconnectError
+}
@@ -0,0 +1,219 @@
+package easytcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/common"
+	"github.com/Ghytro/easytcp/internal/connection"
+)
+
+// ErrNoEndpoints is returned from the sessions while the client has no endpoints
+var ErrNoEndpoints = errors.New("client has no endpoints")
+
+// Endpoint is the server the client balances the sessions across
+type Endpoint struct {
+	Address string
+
+	// Weight is used by the weighted balancer and the hash
+	// ring of the keyed sessions. Defaults to 1
+	Weight int
+}
+
+// Resolver returns the current endpoints of the client
+type Resolver func(ctx context.Context) ([]Endpoint, error)
+
+// ClientEndpoint is the endpoint of the client having its own connection pool
+type ClientEndpoint struct {
+	address string
+	weight  atomic.Int64
+	pool    *connection.Pool
+
+	// the active sessions and the ones waiting for the connection
+	outstanding atomic.Int64
+}
+
+func (e *ClientEndpoint) Address() string {
+	return e.address
+}
+
+func (e *ClientEndpoint) Weight() int {
+	return int(e.weight.Load())
+}
+
+// Outstanding returns the amount of the active sessions of the endpoint
+// and the ones waiting for its connection
+func (e *ClientEndpoint) Outstanding() int {
+	return int(e.outstanding.Load())
+}
+
+// Stats returns the snapshot of the connection pool metrics of the endpoint
+func (e *ClientEndpoint) Stats() ClientStats {
+	return e.pool.Stats()
+}
+
+// setWeight reports if the weight is changed
+func (e *ClientEndpoint) setWeight(weight int) bool {
+	if weight <= 0 {
+		weight = 1
+	}
+	return e.weight.Swap(int64(weight)) != int64(weight)
+}
+
+// Endpoints returns the current endpoints of the client
+func (c *Client) Endpoints() []*ClientEndpoint {
+	return append([]*ClientEndpoint(nil), *c.endpoints.Load()...)
+}
+
+// AddEndpoint starts balancing the sessions to the endpoint as well.
+// Its connections are configured the same as the ones of the others
+func (c *Client) AddEndpoint(endpoint Endpoint) error {
+	c.endpointsMu.Lock()
+	defer c.endpointsMu.Unlock()
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+	if endpoint.Address == "" {
+		return common.WrapErr(errors.New("endpoint address is not set"))
+	}
+	endpoints := *c.endpoints.Load()
+	for _, e := range endpoints {
+		if e.address == endpoint.Address {
+			return common.WrapErr(fmt.Errorf("endpoint %s is already added", endpoint.Address))
+		}
+	}
+	cfg := c.poolCfg
+	cfg.Address = endpoint.Address
+	pool, err := connection.NewPool(c.ctx, cfg)
+	if err != nil {
+		return err
+	}
+	e := &ClientEndpoint{address: endpoint.Address, pool: pool}
+	e.setWeight(endpoint.Weight)
+	// the slice is replaced, so the sessions picking from the old one are not disturbed
+	updated := append(endpoints[:len(endpoints):len(endpoints)], e)
+	c.endpoints.Store(&updated)
+	c.rebuildRing()
+	return nil
+}
+
+// RemoveEndpoint stops balancing the new sessions to the endpoint, waits for
+// its active sessions to complete and closes its connections. If ctx is done
+// before, the connections are closed while in use and the error of ctx is returned
+func (c *Client) RemoveEndpoint(ctx context.Context, address string) error {
+	e, err := c.removeEndpoint(address)
+	if err != nil {
+		return err
+	}
+	return c.closeRemoved(ctx, e)
+}
+
+func (c *Client) removeEndpoint(address string) (*ClientEndpoint, error) {
+	c.endpointsMu.Lock()
+	defer c.endpointsMu.Unlock()
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	endpoints := *c.endpoints.Load()
+	for i, e := range endpoints {
+		if e.address != address {
+			continue
+		}
+		updated := make([]*ClientEndpoint, 0, len(endpoints)-1)
+		updated = append(append(updated, endpoints[:i]...), endpoints[i+1:]...)
+		// Stats sees the endpoint either current or removed
+		c.statsMu.Lock()
+		c.endpoints.Store(&updated)
+		c.removed[e] = struct{}{}
+		c.statsMu.Unlock()
+		c.rebuildRing()
+		return e, nil
+	}
+	return nil, common.WrapErr(fmt.Errorf("endpoint %s is not found", address))
+}
+
+// closeRemoved closes the pool of the removed endpoint
+// and keeps its final counters in Stats
+func (c *Client) closeRemoved(ctx context.Context, e *ClientEndpoint) error {
+	err := e.pool.Close(ctx)
+	c.statsMu.Lock()
+	delete(c.removed, e)
+	addCounters(&c.retired, e.pool.Stats())
+	c.statsMu.Unlock()
+	return err
+}
+
+// resolve replaces the endpoints with the resolved ones. The weights of the
+// kept endpoints are updated, the removed ones are closed in the background
+func (c *Client) resolve(ctx context.Context) error {
+	resolved, err := c.resolver(ctx)
+	if err != nil {
+		return err
+	}
+	weights := make(map[string]int, len(resolved))
+	for _, endpoint := range resolved {
+		weights[endpoint.Address] = endpoint.Weight
+	}
+	reweighted := false
+	for _, e := range c.Endpoints() {
+		weight, ok := weights[e.address]
+		if ok {
+			reweighted = e.setWeight(weight) || reweighted
+			delete(weights, e.address)
+			continue
+		}
+		if e, err := c.removeEndpoint(e.address); err == nil {
+			go c.closeRemoved(context.Background(), e)
+		}
+	}
+	for _, endpoint := range resolved {
+		if _, ok := weights[endpoint.Address]; !ok {
+			continue
+		}
+		if err := c.AddEndpoint(endpoint); err != nil {
+			return err
+		}
+		delete(weights, endpoint.Address)
+	}
+	if reweighted {
+		c.endpointsMu.Lock()
+		c.rebuildRing()
+		c.endpointsMu.Unlock()
+	}
+	return nil
+}
+
+// resolveLoop resolves the endpoints every interval until the client is closed.
+// The failed resolve keeps the endpoints as they are
+func (c *Client) resolveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.resolve(c.ctx)
+		case <-c.done:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// pick chooses the endpoint for the session with the balancer
+func (c *Client) pick() (*ClientEndpoint, error) {
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	endpoints := *c.endpoints.Load()
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if len(endpoints) == 1 {
+		return endpoints[0], nil
+	}
+	return endpoints[c.balancer.Pick(endpoints)], nil
+}
@@ -0,0 +1,90 @@
+package easytcp
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Ghytro/easytcp/internal/connection"
+	"github.com/Ghytro/easytcp/internal/frame"
+)
+
+// ErrTimeout is returned when the read or write timeout of the connection
+// expires. It satisfies net.Error, so both errors.Is(err, ErrTimeout) and
+// the Timeout method of net.Error can be used to check it
+var ErrTimeout = connection.ErrTimeout
+
+// Error is an error sent to the client in the error frame of the framed
+// protocol. Handlers return it to reply with the error and keep the connection
+// open. Clients get it from IConnection.ReadFrame, use errors.As to inspect it
+type Error = frame.Error
+
+// ErrorCode classifies the Error. The codes below 100 are reserved by easytcp
+type ErrorCode = frame.ErrorCode
+
+const (
+	CodeUnknown          = frame.CodeUnknown
+	CodeInternal         = frame.CodeInternal
+	CodeBadRequest       = frame.CodeBadRequest
+	CodeNotAllowed       = frame.CodeNotAllowed
+	CodeDeadlineExceeded = frame.CodeDeadlineExceeded
+)
+
+// NewError creates the error to be sent to the client
+func NewError(code ErrorCode, message string, details ...[]byte) *Error {
+	e := &Error{
+		Code:    code,
+		Message: message,
+	}
+	if len(details) != 0 {
+		e.Details = details[0]
+	}
+	return e
+}
+
+// ErrAction tells the server what to do after the error
+// returned from the message handlers
+type ErrAction int
+
+const (
+	// ErrActionClose closes the connection
+	ErrActionClose ErrAction = iota
+
+	// ErrActionContinue drops the response of the failed message
+	// and keeps handling the next ones
+	ErrActionContinue
+
+	// ErrActionReply sends the error frame to the client instead of the
+	// response and keeps the connection open. The errors that are not
+	// *Error are sent with CodeInternal. Requires the framed protocol,
+	// otherwise the connection is closed
+	ErrActionReply
+)
+
+// wireError converts the error to the one sent to the client.
+// Returns false if the error has no wire representation
+func wireError(err error) (*Error, bool) {
+	var wireErr *Error
+	switch {
+	case errors.As(err, &wireErr):
+		return wireErr, true
+	case errors.Is(err, ErrMessageNotAllowed):
+		return NewError(CodeNotAllowed, err.Error()), true
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewError(CodeDeadlineExceeded, err.Error()), true
+	}
+	return nil, false
+}
+
+// handledError is the error that was already passed to the error
+// handler, so the connection is closed without handling it again
+type handledError struct {
+	err error
+}
+
+func (e *handledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handledError) Unwrap() error {
+	return e.err
+}
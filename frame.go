@@ -0,0 +1,26 @@
+package easytcp
+
+import "github.com/Ghytro/easytcp/internal/frame"
+
+// Frame is a single message of the easytcp framed protocol. Every frame is
+// sent with a fixed header carrying the payload length, flags and id, which
+// correlates the request with its response. The server works with frames
+// only when ServerConfig.Framed is set, clients read and write them with
+// IConnection.ReadFrame and IConnection.WriteFrame
+type Frame = frame.Frame
+
+// FrameFlags describe the frame and its optional header fields
+type FrameFlags = frame.Flags
+
+const (
+	// FrameFlagTimeout means that the frame carries the timeout to handle it
+	FrameFlagTimeout = frame.FlagTimeout
+
+	// FrameFlagError means that the payload is the encoded *Error
+	FrameFlagError = frame.FlagError
+
+	// FrameFlagPush is set on the frames sent with ServerContext.SendAsync.
+	// They are not responses, so their id is always zero and must not be
+	// matched with the request of zero id
+	FrameFlagPush = frame.FlagPush
+)
@@ -0,0 +1,84 @@
+// Package bufpool keeps the byte buffers in size-classed pools,
+// so the hot path reuses the memory instead of allocating it
+package bufpool
+
+import (
+	"bytes"
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// minClassBits is the size of the smallest class, 64 bytes
+	minClassBits = 6
+
+	// maxClassBits is the size of the largest class, 16 MB.
+	// Larger buffers are allocated and dropped as usual
+	maxClassBits = 24
+)
+
+// pools keep the pointers to the arrays of the class size. Unlike
+// the slices, the pointers are stored in sync.Pool without allocation
+var pools [maxClassBits - minClassBits + 1]sync.Pool
+
+// class returns the index of the smallest class fitting n bytes
+func class(n int) int {
+	if n <= 1<<minClassBits {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minClassBits
+}
+
+// Get returns the buffer of length n. Its capacity is rounded up to
+// the size class, so it can be returned to the pool with Put
+func Get(n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	c := class(n)
+	if c >= len(pools) {
+		return make([]byte, n)
+	}
+	if p, ok := pools[c].Get().(unsafe.Pointer); ok {
+		return unsafe.Slice((*byte)(p), 1<<(c+minClassBits))[:n]
+	}
+	return make([]byte, n, 1<<(c+minClassBits))
+}
+
+// Put returns the buffer to the pool. The buffers which capacity is not
+// a size class are dropped. The buffer must not be used after Put
+func Put(b []byte) {
+	size := cap(b)
+	if size < 1<<minClassBits || size&(size-1) != 0 {
+		return
+	}
+	c := class(size)
+	if c >= len(pools) {
+		return
+	}
+	pools[c].Put(unsafe.Pointer(unsafe.SliceData(b[:1])))
+}
+
+// maxBufferSize is the capacity of the largest bytes.Buffer returned
+// to the pool, so a single huge response doesn't stay in memory forever
+const maxBufferSize = 64 << 10
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns the empty buffer from the pool
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer resets the buffer and returns it to the pool.
+// The buffer must not be used after PutBuffer
+func PutBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
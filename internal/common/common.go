@@ -1,101 +1,62 @@
 package common
 
-import "golang.org/x/exp/constraints"
+import (
+	"sync"
 
-type KVStore map[string]interface{}
+	"golang.org/x/exp/constraints"
+)
 
-func (store KVStore) Get(key string) (interface{}, bool) {
-	el, ok := store[key]
-	return el, ok
-}
-
-func (store KVStore) MustGet(key string) interface{} {
-	return store[key]
+// KVStore is a thread-safe storage of the values of any type. The keys
+// can be of any comparable type, so the packages can use unexported key
+// types to avoid collisions
+type KVStore struct {
+	mu   sync.Mutex
+	vals map[interface{}]interface{}
 }
 
-func (store KVStore) MustGetBool(key string) bool {
-	el, ok := store[key]
-	if !ok {
-		return false
-	}
-	return el.(bool)
+func NewKVStore() *KVStore {
+	return &KVStore{}
 }
 
-func (store KVStore) MustGetFloat(key string) float64 {
-	el, ok := store[key]
-	if !ok {
-		return 0
-	}
-	return el.(float64)
-}
-
-func (e KVStore) MustGetStr(key string) string {
-	result, ok := e[key]
-	if !ok {
-		return ""
-	}
-	return result.(string)
+func (store *KVStore) Get(key interface{}) (interface{}, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	el, ok := store.vals[key]
+	return el, ok
 }
 
-func (e KVStore) MustGetInt(key string) int {
-	result, ok := e[key]
-	if !ok {
-		return 0
-	}
-	i, ok := result.(int)
-	// это обусловлено тем, что linObjExtra на самом деле
-	// парсится из жсона, interface{} не понимает int и парсит все как
-	// float64, поэтому на всякий случай делаем вот такой фоллбек
-	if !ok {
-		f, ok := result.(float64)
-		if !ok {
-			return 0
-		}
-		return int(f)
+func (store *KVStore) Set(key, value interface{}) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.vals == nil {
+		store.vals = map[interface{}]interface{}{}
 	}
-	return i
+	store.vals[key] = value
 }
 
-// MustGetIntSlice создает копию слайса для того чтобы получить нужного типа
-func (e KVStore) MustGetIntSlice(key string) []int {
-	result, ok := e[key]
-	if !ok {
-		return nil
-	}
-	resultSlice, ok := result.([]interface{})
-	if !ok {
-		return nil
-	}
-	result = make([]int, len(resultSlice))
-	resInt := result.([]int)
-	for i, el := range resultSlice {
-		resInt[i], ok = el.(int)
-		if !ok {
-			// float64 из за парсинга жсона
-			f, ok := el.(float64)
-			if !ok {
-				return nil
-			}
-			resInt[i] = int(f)
-		}
-	}
-	return resInt
+func (store *KVStore) Delete(key interface{}) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.vals, key)
 }
 
-func (e KVStore) MustGetInterfaceMap(key string) map[string]interface{} {
-	result, ok := e[key]
-	if !ok {
-		return nil
-	}
-	return result.(map[string]interface{})
+// Reset deletes all the values, keeping the memory for the next ones
+func (store *KVStore) Reset() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	clear(store.vals)
 }
 
-func (e KVStore) MustGetInterfaceSlice(key string) []interface{} {
-	result, ok := e[key]
+// GetAs retreives the value from store by it's key. Returns false if the value
+// is not present or is not of type T
+func GetAs[T any](store *KVStore, key interface{}) (T, bool) {
+	el, ok := store.Get(key)
 	if !ok {
-		return nil
+		var zero T
+		return zero, false
 	}
-	return result.([]interface{})
+	result, ok := el.(T)
+	return result, ok
 }
 
 func Max[T constraints.Ordered](a, b T) T {
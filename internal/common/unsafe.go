@@ -5,5 +5,8 @@ import "unsafe"
 // Str2B zero allocation string convertion
 // to byte slice
 func Str2B(s string) []byte {
-	return *(*[]byte)(unsafe.Pointer(&s))
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
 }
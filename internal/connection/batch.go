@@ -0,0 +1,135 @@
+package connection
+
+import (
+	"net"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/bufpool"
+	"github.com/Ghytro/easytcp/internal/common"
+)
+
+// BatchConfig configures gathering of the small writes, which are
+// then flushed to the socket with a single vectored write
+type BatchConfig struct {
+	// MaxSize is the amount of gathered bytes after which the batch is
+	// flushed. The writes of at least MaxSize bytes are not gathered.
+	// Zero disables batching, so every write goes to the socket at once
+	MaxSize int
+
+	// MaxDelay is the longest time the gathered write waits for the flush.
+	// Zero means that the batch waits for Flush, for the next read or
+	// for growing over MaxSize
+	MaxDelay time.Duration
+}
+
+// writeBatch keeps the copies of the gathered writes.
+// Guarded by the write mutex of the connection
+type writeBatch struct {
+	BatchConfig
+
+	// pooled copies of the writes in order
+	bufs [][]byte
+	size int
+
+	// vec is consumed by the vectored write, so it's filled
+	// from bufs before every flush. It's backed by vecs
+	vec   net.Buffers
+	vecs  [][]byte
+	timer *time.Timer
+}
+
+// gather adds the copy of b to the batch. The batch is flushed before
+// if b doesn't fit it. The large writes go to the socket at once.
+// Must be called with the write mutex locked
+func (c *Connection) gather(b []byte) (int, error) {
+	batch := &c.batch
+	if batch.size+len(b) > batch.MaxSize {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(b) >= batch.MaxSize {
+			return c.write(nil, deadlineAfter(c.writeTimeout), b)
+		}
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	buf := bufpool.Get(len(b))
+	copy(buf, b)
+	batch.bufs = append(batch.bufs, buf)
+	batch.size += len(b)
+
+	if batch.MaxDelay > 0 && len(batch.bufs) == 1 {
+		if batch.timer == nil {
+			batch.timer = time.AfterFunc(batch.MaxDelay, c.flushDelayed)
+		} else {
+			batch.timer.Reset(batch.MaxDelay)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes all the gathered writes to the socket with a single vectored
+// write bounded by the write timeout. The part of the batch may be written
+// on error, so the connection is closed then even if it keeps open on timeouts.
+// Does nothing if the batching is disabled
+func (c *Connection) Flush() error {
+	if c.batch.MaxSize <= 0 {
+		return nil
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *Connection) flushLocked() error {
+	batch := &c.batch
+	if len(batch.bufs) == 0 {
+		return nil
+	}
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	batch.vecs = append(batch.vecs[:0], batch.bufs...)
+	batch.vec = batch.vecs
+	err := c.writeBuffers(&batch.vec)
+	batch.reset()
+	if err != nil {
+		return common.NestedCloseConnErr(err, c.Close())
+	}
+	return nil
+}
+
+// reset releases the gathered writes
+func (batch *writeBatch) reset() {
+	for i, buf := range batch.bufs {
+		bufpool.Put(buf)
+		batch.bufs[i] = nil
+	}
+	batch.bufs = batch.bufs[:0]
+	batch.size = 0
+}
+
+// writeBuffers writes the buffers with a single vectored
+// write if the connection supports it
+func (c *Connection) writeBuffers(bufs *net.Buffers) error {
+	if err := c.conn.SetWriteDeadline(deadlineAfter(c.writeTimeout)); err != nil {
+		return err
+	}
+	n, err := bufs.WriteTo(c.conn)
+	c.countWritten(n)
+	if err != nil {
+		return c.ioErr(nil, err)
+	}
+	return nil
+}
+
+// flushDelayed flushes the batch once the MaxDelay expires.
+// The error closes the connection, so it's returned by the next I/O
+func (c *Connection) flushDelayed() {
+	c.Flush()
+}
+
+func (c *Connection) batching() bool {
+	return c.batch.MaxSize > 0
+}
@@ -0,0 +1,26 @@
+package connection
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// readerPools keeps the released read buffers by their size
+var readerPools sync.Map // map[int]*sync.Pool
+
+func getReader(size int, r io.Reader) *bufio.Reader {
+	if pool, ok := readerPools.Load(size); ok {
+		if br, ok := pool.(*sync.Pool).Get().(*bufio.Reader); ok {
+			br.Reset(r)
+			return br
+		}
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	pool, _ := readerPools.LoadOrStore(br.Size(), &sync.Pool{})
+	pool.(*sync.Pool).Put(br)
+}
@@ -1,16 +1,38 @@
 package connection
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Ghytro/easytcp/internal/bufpool"
 	"github.com/Ghytro/easytcp/internal/common"
+	"github.com/Ghytro/easytcp/internal/frame"
 )
 
+// ErrWaitTimeout is returned from Connection.WaitForPacketTimeout when
+// no packet arrived in the given time. The connection stays open
+var ErrWaitTimeout = errors.New("no packet arrived in time")
+
+// ErrTimeout is returned when the read or write timeout expires. It satisfies
+// net.Error, so it can be checked both with errors.Is and with Timeout method
+var ErrTimeout net.Error = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// ErrTooLong is returned from Connection.ReadUntil when the delimiter
+// is not found within the max frame size
+var ErrTooLong = errors.New("delimiter not found within the max frame size")
+
 type IConnectionMixin interface {
 	Dial() error
 }
@@ -25,12 +47,67 @@ type IConnectionWriter interface {
 	IConnectionMixin
 	io.Writer
 	WriteContext(ctx context.Context, b []byte) (n int, err error)
+	Flush() error
+}
+
+// IConnectionBufferedReader reads from the connection through its read
+// buffer, so the protocols don't have to implement buffering by themselves
+type IConnectionBufferedReader interface {
+	IConnectionMixin
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+	ReadFull(b []byte) (n int, err error)
+	ReadUntil(delim byte) ([]byte, error)
+	Discard(n int) (discarded int, err error)
+}
+
+// IConnectionHalfCloser shuts down one direction of the connection,
+// so the peer reads io.EOF while the other direction keeps working
+type IConnectionHalfCloser interface {
+	IConnectionMixin
+	CloseWrite() error
+	CloseRead() error
+}
+
+// IConnectionFramer reads and writes the messages
+// of the easytcp framed protocol
+type IConnectionFramer interface {
+	IConnectionMixin
+	ReadFrame() (frame.Frame, error)
+	ReleaseFrame(f frame.Frame)
+	WriteFrame(f frame.Frame) error
 }
 
 type ConnectionConfig struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	DialTimeout  time.Duration
+
+	// MaxFrameSize limits the payload size of the frames read
+	// and the data read with ReadUntil
+	MaxFrameSize int
+
+	// ReadBufferSize is the size of the read buffer. Peek can't
+	// look further than that. The buffer is at least 64 bytes
+	ReadBufferSize int
+
+	// WriteBatch gathers the small writes and flushes them at once.
+	// The pending writes are flushed before every blocking read
+	WriteBatch BatchConfig
+
+	// Socket tunes the sockets dialed by the connection and the pool
+	Socket SocketOptions
+
+	// Counters counts the bytes read and written, may be shared by many connections
+	Counters *IOCounters
+
+	// OnClose is called once the connection is closed
+	OnClose func()
+
+	// KeepOpenOnTimeout makes the expired read and write timeouts return
+	// ErrTimeout and leave the connection usable. By default the connection
+	// is closed on timeout, because the data may be written partially
+	KeepOpenOnTimeout bool
 }
 
 func (c *ConnectionConfig) setDefault() {
@@ -43,12 +120,24 @@ func (c *ConnectionConfig) setDefault() {
 	if c.DialTimeout == 0 {
 		c.DialTimeout = DefaultConnectionConfig.DialTimeout
 	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = DefaultConnectionConfig.MaxFrameSize
+	}
+	if c.ReadBufferSize <= 0 {
+		c.ReadBufferSize = DefaultConnectionConfig.ReadBufferSize
+	}
 }
 
+// minReadBufferSize fits the longest frame header, so it can be peeked
+const minReadBufferSize = 64
+
 var DefaultConnectionConfig = ConnectionConfig{
 	ReadTimeout:  time.Second * 10,
 	WriteTimeout: time.Second * 10,
 	DialTimeout:  time.Second * 10,
+	MaxFrameSize: frame.DefaultMaxSize,
+
+	ReadBufferSize: 4096,
 }
 
 // Connection is an extended structure for standard library net.Conn.
@@ -57,7 +146,9 @@ var DefaultConnectionConfig = ConnectionConfig{
 // the functionality of client/server is enough. But the usage is still available
 // only if you really need more of low-level socket control.
 //
-// THIS STRUCTURE IS NOT THREAD SAFE AND IS NOT MEANT FOR MULTITHREAD USAGE
+// THE READS ARE NOT THREAD SAFE AND ARE NOT MEANT FOR MULTITHREAD USAGE.
+// The writes are safe for concurrent use, every write goes to the socket
+// as a whole, so the messages written concurrently are never interleaved
 type Connection struct {
 	// underlying connection context with cancelation signal
 	ctx context.Context
@@ -68,15 +159,38 @@ type Connection struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	dialTimeout  time.Duration
+	maxFrameSize int
+
+	// if the connection stays open when the I/O timeout expires
+	keepOpenOnTimeout bool
 
 	// If the connection was closed, this channel notifies the consumer.
 	// The signal will be produced once, so this channel needs to be piped
 	closeNotifier chan struct{}
-	notifyOnce    sync.Once
+	closed        atomic.Bool
+	// closeMu serializes closing the connection and reopening it by Dial
+	closeMu sync.Mutex
+
+	// stops closing the connection once the context is done
+	stopCtxWatch func() bool
+
+	// reader buffers everything read from the connection. Taken
+	// from the pool on the first read, see ReleaseBuffer
+	reader     *bufio.Reader
+	readerSize int
+	onClose    func()
+
+	// options applied to the sockets dialed by Dial
+	socket SocketOptions
 
-	// bufferedByte determines if the client sent packets to server.
-	// Is used in Connection.WaitForPacket
-	bufferedByte *byte
+	// nil if the transferred bytes are not counted
+	counters *IOCounters
+
+	// writeMu serializes the writes
+	writeMu sync.Mutex
+
+	// gathered writes, used if the batching is enabled
+	batch writeBatch
 }
 
 func NewConnection(ctx context.Context, conn net.Conn, config ...ConnectionConfig) *Connection {
@@ -85,135 +199,543 @@ func NewConnection(ctx context.Context, conn net.Conn, config ...ConnectionConfi
 	}
 	cfg := config[0]
 	cfg.setDefault()
-	return &Connection{
+	c := &Connection{
 		ctx:           ctx,
 		conn:          conn,
 		readTimeout:   cfg.ReadTimeout,
 		writeTimeout:  cfg.WriteTimeout,
 		dialTimeout:   cfg.DialTimeout,
+		maxFrameSize:  cfg.MaxFrameSize,
 		closeNotifier: make(chan struct{}, 1),
+		readerSize:    common.Max(cfg.ReadBufferSize, minReadBufferSize),
+		onClose:       cfg.OnClose,
+		socket:        cfg.Socket,
+		counters:      cfg.Counters,
+
+		keepOpenOnTimeout: cfg.KeepOpenOnTimeout,
 	}
+	// the connection is closed once its context is done, that
+	// also interrupts all the I/O blocked at the moment
+	c.batch.BatchConfig = cfg.WriteBatch
+	c.stopCtxWatch = context.AfterFunc(ctx, func() {
+		c.close()
+	})
+	return c
 }
 
-func (c *Connection) Dial() (err error) {
-	var conn net.Conn
-	err = common.WithTimeout(
-		c,
-		c.dialTimeout,
-		func(tcpConn *Connection) error {
-			conn, err = net.Dial("tcp", c.RemoteAddr())
-			return err
-		},
-		func(tcpConn *Connection) error {
-			return conn.Close()
-		},
-	)
-
+// Dial establishes the new connection to the same remote address
+// and replaces the current one with it. The connection closed before
+// is usable again once it's redialed
+func (c *Connection) Dial() error {
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	conn, err := dialer.DialContext(c.ctx, "tcp", c.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	if err := SetSocketOptions(conn, c.socket); err != nil {
+		return common.NestedCloseConnErr(err, conn.Close())
+	}
+	// the concurrent writes must not see the connection being replaced
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	c.conn.Close()
+	c.conn = conn
+	// the pending writes were meant for the old connection
+	c.batch.reset()
+	if c.reader != nil {
+		c.buffer().Reset(connReader{c})
+	}
+	if c.closed.Load() {
+		c.reopen()
+	}
 	return nil
 }
 
+// reopen resets the close state, so the redialed connection
+// can be closed and watches its context again. Must be
+// called with closeMu locked
+func (c *Connection) reopen() {
+	c.stopCtxWatch()
+	select {
+	case <-c.closeNotifier:
+	default:
+	}
+	c.closed.Store(false)
+	c.stopCtxWatch = context.AfterFunc(c.ctx, func() {
+		c.close()
+	})
+}
+
 // WaitForPacket blocks until the packet arrives to socket.
 // The only way to stop awaiting the incoming packet is to close the connection
 func (c *Connection) WaitForPacket() error {
-	if c.bufferedByte != nil {
+	return c.waitForPacket(time.Time{})
+}
+
+// WaitForPacketTimeout is the same as WaitForPacket, but stops awaiting
+// after the given timeout and returns ErrWaitTimeout. Unlike the read timeouts,
+// this one doesn't close the connection. Zero or negative timeout means no timeout
+func (c *Connection) WaitForPacketTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return c.WaitForPacket()
+	}
+	err := c.waitForPacket(time.Now().Add(timeout))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrWaitTimeout
+	}
+	return err
+}
+
+// Buffered returns the amount of bytes that can
+// be read without touching the socket
+func (c *Connection) Buffered() int {
+	if c.reader == nil {
+		return 0
+	}
+	return c.reader.Buffered()
+}
+
+// ReleaseBuffer returns the empty read buffer to the pool, so the
+// connection doesn't hold any memory while waiting for the data.
+// The buffer is taken again on the next read. Reports if the
+// buffer was released, it's not if there is buffered data
+func (c *Connection) ReleaseBuffer() bool {
+	if c.Buffered() != 0 {
+		return false
+	}
+	if c.reader != nil {
+		putReader(c.reader)
+		c.reader = nil
+	}
+	return true
+}
+
+func (c *Connection) buffer() *bufio.Reader {
+	if c.reader == nil {
+		c.reader = getReader(c.readerSize, connReader{c})
+	}
+	return c.reader
+}
+
+// waitForPacket peeks the first byte of the packet without copying it
+func (c *Connection) waitForPacket(deadline time.Time) error {
+	if c.Buffered() != 0 {
 		return nil
 	}
-	temp := make([]byte, 1)
-	n, err := c.conn.Read(temp)
-	if err != nil {
+	if err := c.Flush(); err != nil {
 		return err
 	}
-	if n != 1 {
-		return common.WrapErr(errors.New("wait byte was not received"))
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return err
 	}
-	c.bufferedByte = &temp[0]
-	return nil
+	_, err := c.buffer().Peek(1)
+	return err
 }
 
+// Read reads from the connection bounded by the read timeout. If the timeout
+// expires, ErrTimeout is returned. The connection is closed on any error,
+// unless it's the timeout and the connection keeps open on timeouts. io.EOF
+// leaves the connection open, so the peer that half-closed it gets the reply
 func (c *Connection) Read(b []byte) (n int, err error) {
-	ctx, cancel := context.WithTimeout(c.ctx, c.readTimeout)
-	defer cancel()
-	return c.ReadContext(ctx, b)
+	return c.read(nil, deadlineAfter(c.readTimeout), b)
 }
 
 func (c *Connection) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
 
+// ReadContext reads from the connection until the context is done. If the
+// context is done, it's error is returned. The connection is closed on any error,
+// unless it's the context one and the connection keeps open on timeouts
 func (c *Connection) ReadContext(ctx context.Context, b []byte) (n int, err error) {
+	deadline, _ := ctx.Deadline()
+	return c.read(ctx, deadline, b)
+}
+
+// read reads from the connection until the deadline. If the context is
+// given, it's cancellation interrupts the read as well
+func (c *Connection) read(ctx context.Context, deadline time.Time, b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, errors.New("received zero length of reader buffer")
 	}
-	offset := 0
-	// if the packet was awaited we need to store
-	// temporary byte too
-	if c.bufferedByte != nil {
-		b[0] = *c.bufferedByte
-		c.bufferedByte = nil
-		offset = 1
-		if len(b) == 1 {
-			return 1, nil
-		}
+	// the buffered data is returned without touching the socket
+	if c.Buffered() != 0 {
+		return c.buffer().Read(b)
 	}
-	err = common.WithContext(
-		ctx,
-		c,
-		func(c *Connection) error {
-			n, err = c.conn.Read(b[offset:])
-			n += offset
+	err = c.readBuffered(ctx, deadline, func() (err error) {
+		n, err = c.buffer().Read(b)
+		return err
+	})
+	return n, err
+}
+
+// readBuffered runs the read from the read buffer until the deadline. If the
+// context is given, it's cancellation interrupts the read as well
+func (c *Connection) readBuffered(ctx context.Context, deadline time.Time, read func() error) error {
+	// the peer may wait for the pending writes before sending anything
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return common.NestedCloseConnErr(err, c.Close())
+	}
+	stop := interruptOnDone(ctx, c.conn, readDeadline)
+	defer stop()
+
+	if err := read(); err != nil {
+		if usageErr(err) {
 			return err
-		},
-		func(c *Connection) error {
-			return c.Close()
-		},
-	)
-	if err != nil {
-		err := err.(*common.WithTimeoutError)
-		if err.CleanupErr == nil {
-			err.CleanupErr = c.Close()
 		}
-		return n, common.NestedCloseConnErr(err.Err, err.CleanupErr)
+		return c.ioErr(ctx, err)
+	}
+	return nil
+}
+
+// usageErr reports if the read failed because of its arguments or the size
+// of the read buffer, so the connection is not broken and stays open
+func usageErr(err error) bool {
+	return err == bufio.ErrBufferFull || err == bufio.ErrNegativeCount || err == ErrTooLong
+}
+
+// Peek returns the next n bytes without advancing the reader. The bytes
+// stay valid until the next read. If n is larger than the read buffer,
+// bufio.ErrBufferFull is returned at once and the connection stays open.
+// The whole peek is bounded by the read timeout
+func (c *Connection) Peek(n int) ([]byte, error) {
+	if n > c.buffer().Size() {
+		return nil, bufio.ErrBufferFull
+	}
+	if c.Buffered() >= n {
+		return c.buffer().Peek(n)
+	}
+	var b []byte
+	err := c.readBuffered(nil, deadlineAfter(c.readTimeout), func() (err error) {
+		b, err = c.buffer().Peek(n)
+		return err
+	})
+	return b, err
+}
+
+// ReadFull reads exactly len(b) bytes. The whole read
+// is bounded by the read timeout
+func (c *Connection) ReadFull(b []byte) (n int, err error) {
+	if c.Buffered() >= len(b) {
+		return io.ReadFull(c.buffer(), b)
+	}
+	err = c.readBuffered(nil, deadlineAfter(c.readTimeout), func() (err error) {
+		n, err = io.ReadFull(c.buffer(), b)
+		return err
+	})
+	return n, err
+}
+
+// ReadByte reads a single byte bounded by the read timeout
+func (c *Connection) ReadByte() (b byte, err error) {
+	if c.Buffered() != 0 {
+		return c.buffer().ReadByte()
+	}
+	err = c.readBuffered(nil, deadlineAfter(c.readTimeout), func() (err error) {
+		b, err = c.buffer().ReadByte()
+		return err
+	})
+	return b, err
+}
+
+// ReadUntil reads until the first occurence of delim and returns the data
+// including the delimiter. If the delimiter is not found within the max frame
+// size, ErrTooLong is returned and the connection stays open. On error the
+// data read before it is returned. The whole read is bounded by the read timeout
+func (c *Connection) ReadUntil(delim byte) (b []byte, err error) {
+	err = c.readBuffered(nil, deadlineAfter(c.readTimeout), func() error {
+		for {
+			chunk, err := c.buffer().ReadSlice(delim)
+			b = append(b, chunk...)
+			if len(b) > c.maxFrameSize {
+				return ErrTooLong
+			}
+			if err != bufio.ErrBufferFull {
+				return err
+			}
+		}
+	})
+	return b, err
+}
+
+// Discard skips the next n bytes. The whole
+// discard is bounded by the read timeout
+func (c *Connection) Discard(n int) (discarded int, err error) {
+	if c.Buffered() >= n {
+		return c.buffer().Discard(n)
 	}
-	return
+	err = c.readBuffered(nil, deadlineAfter(c.readTimeout), func() (err error) {
+		discarded, err = c.buffer().Discard(n)
+		return err
+	})
+	return discarded, err
 }
 
+// Write writes to the connection bounded by the write timeout. If the timeout
+// expires, ErrTimeout is returned. The connection is closed on any error,
+// unless it's the timeout and the connection keeps open on timeouts. If the
+// batching is enabled, the small writes are gathered, so their errors are
+// returned by the flush
 func (c *Connection) Write(b []byte) (n int, err error) {
-	ctx, cancel := context.WithTimeout(c.ctx, c.writeTimeout)
-	defer cancel()
-	return c.WriteContext(ctx, b)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.batching() {
+		return c.gather(b)
+	}
+	return c.write(nil, deadlineAfter(c.writeTimeout), b)
 }
 
+// WriteContext writes to the connection until the context is done. If the
+// context is done, it's error is returned. The connection is closed on any error,
+// unless it's the context one and the connection keeps open on timeouts. The
+// gathered writes are flushed before, but the write itself is never gathered
 func (c *Connection) WriteContext(ctx context.Context, b []byte) (n int, err error) {
-	err = common.WithContext(
-		ctx,
-		c,
-		func(c *Connection) error {
-			n, err = c.conn.Write(b)
-			return err
-		},
-		func(c *Connection) error {
-			return c.Close()
-		},
-	)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+	deadline, _ := ctx.Deadline()
+	return c.write(ctx, deadline, b)
+}
+
+// write writes to the connection until the deadline. If the context is
+// given, it's cancellation interrupts the write as well
+func (c *Connection) write(ctx context.Context, deadline time.Time, b []byte) (n int, err error) {
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return 0, common.NestedCloseConnErr(err, c.Close())
+	}
+	stop := interruptOnDone(ctx, c.conn, writeDeadline)
+	defer stop()
+
+	n, err = c.conn.Write(b)
+	c.countWritten(int64(n))
 	if err != nil {
-		err := err.(*common.WithTimeoutError)
-		if err.CleanupErr == nil {
-			err.CleanupErr = c.Close()
+		return n, c.ioErr(ctx, err)
+	}
+	return n, nil
+}
+
+// aLongTimeAgo is the deadline in the past,
+// setting it interrupts the blocked I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptOnDone moves the I/O deadline to the past once the context is done.
+// Must be called after the deadline of the I/O is set, so the interruption is
+// never overwritten. The returned function stops watching the context
+func interruptOnDone(ctx context.Context, conn net.Conn, deadline deadlineKind) (stop func() bool) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	interrupted := make(chan struct{})
+	stopWatch := context.AfterFunc(ctx, func() {
+		if deadline == readDeadline {
+			conn.SetReadDeadline(aLongTimeAgo)
+		} else {
+			conn.SetWriteDeadline(aLongTimeAgo)
+		}
+		close(interrupted)
+	})
+	// the I/O may complete right before the interruption, which must not
+	// leak to the next I/O, so it's awaited if it has already started
+	return func() bool {
+		if stopWatch() {
+			return true
 		}
-		return n, common.NestedCloseConnErr(err.Err, err.CleanupErr)
+		<-interrupted
+		return false
 	}
-	return
+}
+
+// deadlineKind tells which deadline of the connection is interrupted
+type deadlineKind bool
+
+const (
+	readDeadline  deadlineKind = true
+	writeDeadline deadlineKind = false
+)
+
+// ioErr explains the I/O error with ErrTimeout or the context error if the
+// I/O was interrupted by the deadline. The connection is closed on every
+// error, except the interruptions if the connection keeps open on timeouts,
+// and io.EOF, because the peer may have closed only its writing side
+func (c *Connection) ioErr(ctx context.Context, err error) error {
+	if err == io.EOF {
+		return err
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return common.NestedCloseConnErr(err, c.Close())
+	}
+	err = ErrTimeout
+	if ctx != nil {
+		// the socket deadline may expire before the context notices it
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	if c.keepOpenOnTimeout {
+		return err
+	}
+	return common.NestedCloseConnErr(err, c.Close())
+}
+
+// deadlineAfter returns the deadline after the timeout,
+// or no deadline if the timeout is not set
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// ReadFrame reads a single frame of the easytcp framed protocol. The header
+// and the payload reads are bounded by the read timeout. The payload is taken
+// from the buffer pool, the frame may be released with ReleaseFrame once it's
+// not needed anymore. If the error frame is read, the frame is returned along
+// with the decoded *frame.Error. The partially read frame leaves the stream
+// unusable, so the connection is closed then even if it keeps open on timeouts
+func (c *Connection) ReadFrame() (frame.Frame, error) {
+	// the header is only peeked, so the stream stays usable until it's complete
+	header, err := c.Peek(frame.HeaderSize)
+	if err == nil {
+		if n := frame.HeaderLen(frame.Flags(header[4])); n > len(header) {
+			header, err = c.Peek(n)
+		}
+	}
+	if err != nil {
+		return frame.Frame{}, err
+	}
+	f, size, err := frame.ParseHeader(header, c.maxFrameSize)
+	if err != nil {
+		return frame.Frame{}, common.NestedCloseConnErr(err, c.Close())
+	}
+	c.buffer().Discard(len(header))
+
+	f.Payload = bufpool.Get(size)
+	if _, err := c.ReadFull(f.Payload); err != nil {
+		bufpool.Put(f.Payload)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame.Frame{}, common.NestedCloseConnErr(err, c.Close())
+	}
+	if f.Flags&frame.FlagError == 0 {
+		return f, nil
+	}
+	wireErr, err := frame.DecodeError(f.Payload)
+	if err != nil {
+		return f, common.WrapErr(err)
+	}
+	return f, wireErr
+}
+
+// ReleaseFrame returns the payload of the frame read with ReadFrame
+// to the buffer pool. Neither the payload nor its parts must be
+// used after that. Releasing the frame is optional
+func (c *Connection) ReleaseFrame(f frame.Frame) {
+	bufpool.Put(f.Payload)
+}
+
+// WriteFrame writes a single frame of the easytcp framed protocol
+// with one write call. The partially written frame leaves the stream
+// unusable, so the connection is closed then even if it keeps open on timeouts
+func (c *Connection) WriteFrame(f frame.Frame) error {
+	b := frame.Append(bufpool.Get(frame.Size(f))[:0], f)
+	defer bufpool.Put(b)
+	n, err := c.Write(b)
+	if err != nil && n != 0 {
+		return common.NestedCloseConnErr(err, c.Close())
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return common.WrapErr(io.ErrShortWrite)
+	}
+	return nil
+}
+
+// connReader reads the underlying connection bypassing the read buffer,
+// so the buffer follows the connection replaced with Dial
+type connReader struct {
+	c *Connection
+}
+
+func (r connReader) Read(b []byte) (int, error) {
+	n, err := r.c.conn.Read(b)
+	r.c.countRead(int64(n))
+	return n, err
 }
 
 func (c *Connection) Close() error {
-	var err error
-	c.notifyOnce.Do(func() {
-		c.closeNotifier <- struct{}{}
-		err = c.conn.Close()
-	})
+	c.stopCtxWatch()
+	return c.close()
+}
+
+func (c *Connection) close() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed.Load() {
+		return nil
+	}
+	c.closed.Store(true)
+	c.closeNotifier <- struct{}{}
+	err := c.conn.Close()
+	if c.onClose != nil {
+		c.onClose()
+	}
 	return err
 }
 
+// CloseWrite sends the pending writes and shuts down the writing side of the
+// connection, so the peer reads io.EOF once it reads everything sent. The
+// connection can still be read. Returns errors.ErrUnsupported if the
+// underlying connection can't be half-closed
+func (c *Connection) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	conn, ok := c.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return conn.CloseWrite()
+}
+
+// CloseRead shuts down the reading side of the connection. The data already
+// buffered can still be read, then io.EOF is returned. The connection can
+// still be written. Returns errors.ErrUnsupported if the underlying
+// connection can't be half-closed
+func (c *Connection) CloseRead() error {
+	conn, ok := c.conn.(interface{ CloseRead() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return conn.CloseRead()
+}
+
+// Alive reports if the connection is open and the peer hasn't closed it.
+// Doesn't block, the data sent by the peer is left unread
+func (c *Connection) Alive() bool {
+	if c.closed.Load() {
+		return false
+	}
+	if c.Buffered() != 0 {
+		return true
+	}
+	return !c.peerClosed()
+}
+
 func (c *Connection) CloseNotifier() <-chan struct{} {
 	return c.closeNotifier
 }
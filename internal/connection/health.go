@@ -0,0 +1,247 @@
+package connection
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/common"
+)
+
+// HealthCheckConfig configures validation of the pooled connections.
+// The broken connections are closed and redialed before the next use
+type HealthCheckConfig struct {
+	// OnBorrow validates the connection before it's acquired
+	OnBorrow bool
+
+	// OnReturn validates the connection once it's released
+	OnReturn bool
+
+	// Interval is the period of validating the idle connections and
+	// redialing the broken ones. Zero disables the background checks
+	Interval time.Duration
+
+	// Ping validates the connection with the application request. By default
+	// the connection is only checked to be open, see Connection.Alive
+	Ping func(conn *Connection) error
+}
+
+// healthy reports if the connection can be used
+func (p *Pool) healthy(conn *Connection) bool {
+	if !conn.Alive() {
+		return false
+	}
+	return p.health.Ping == nil || p.health.Ping(conn) == nil
+}
+
+// prepare dials the acquired entry if it's empty, broken, expired or
+// fails the health check. Must be called by the owner
+func (p *Pool) prepare(ctx context.Context, entry *poolEntry) error {
+	if entry.conn == nil ||
+		entry.conn.closed.Load() ||
+		p.expired(entry, time.Now()) ||
+		p.health.OnBorrow && !p.healthy(entry.conn) {
+		return p.redial(ctx, entry)
+	}
+	return nil
+}
+
+// expired reports if the connection of the entry outlived its lifetime
+func (p *Pool) expired(entry *poolEntry, now time.Time) bool {
+	return p.maxLifetime > 0 && entry.conn != nil && now.After(entry.expiresAt)
+}
+
+// discard closes the connection of the entry, so it's
+// dialed before the next use. Must be called by the owner
+func (p *Pool) discard(entry *poolEntry) {
+	if entry.conn == nil {
+		return
+	}
+	entry.conn.Close()
+	p.counters.discarded.Add(1)
+	p.poolLock.Lock()
+	entry.conn = nil
+	p.poolLock.Unlock()
+}
+
+// redial replaces the connection of the entry with the new one. The entry
+// stays empty if the dial fails. Must be called by the owner
+func (p *Pool) redial(ctx context.Context, entry *poolEntry) error {
+	p.discard(entry)
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return p.attach(entry, conn)
+}
+
+// attach puts the dialed connection into the empty entry. The connection
+// dialed once the pool is closed is closed as well, so it doesn't leak.
+// Must be called by the owner
+func (p *Pool) attach(entry *poolEntry, conn *Connection) error {
+	p.poolLock.Lock()
+	if p.closed.Load() {
+		p.poolLock.Unlock()
+		conn.Close()
+		return ErrPoolClosed
+	}
+	entry.conn = conn
+	p.poolLock.Unlock()
+
+	now := time.Now()
+	entry.idleSince = now
+	if p.maxLifetime > 0 {
+		jitter := time.Duration(rand.Int63n(int64(p.lifetimeJitter) + 1))
+		entry.expiresAt = now.Add(p.maxLifetime - jitter)
+	}
+	return nil
+}
+
+// dial dials the new connection of the pool until ctx is done or the pool
+// is closed. The failed dial starts reconnecting if it's enabled, unless
+// the caller gave up on it
+func (p *Pool) dial(ctx context.Context) (*Connection, error) {
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.dialCtx, cancel)
+	defer stop()
+
+	dialer := net.Dialer{Timeout: p.connCfg.DialTimeout}
+	conn, err := dialer.DialContext(dialCtx, "tcp", p.address)
+	if err != nil {
+		if err := ctxErr(ctx); err != nil {
+			return nil, err
+		}
+		if p.closed.Load() {
+			return nil, ErrPoolClosed
+		}
+		p.counters.dialErrors.Add(1)
+		p.startReconnect(err)
+		return nil, err
+	}
+	p.counters.dials.Add(1)
+	if err := SetSocketOptions(conn, p.connCfg.Socket); err != nil {
+		return nil, common.NestedCloseConnErr(err, conn.Close())
+	}
+	return NewConnection(p.ctx, conn, p.connCfg), nil
+}
+
+// ctxErr returns the error of ctx, or context.DeadlineExceeded
+// if its deadline is passed, but ctx didn't notice it yet
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// maintainInterval is the period of the background
+// maintenance if the health checks don't set it
+const maintainInterval = time.Second
+
+// maintained reports if the idle connections are maintained in the background
+func (p *Pool) maintained() bool {
+	return p.health.Interval > 0 || p.minIdle > 0 || p.maxIdleTime > 0 || p.maxLifetime > 0
+}
+
+// maintainLoop maintains the idle connections every interval
+func (p *Pool) maintainLoop() {
+	defer p.workers.Done()
+	interval := p.health.Interval
+	if interval <= 0 {
+		interval = maintainInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.maintain()
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// maintain closes the expired idle connections, redials the broken ones
+// if the health checks are enabled and dials the missing MinIdle ones.
+// Nothing is dialed while the pool is reconnecting
+func (p *Pool) maintain() {
+	if p.reconnecting() {
+		return
+	}
+	idle := p.idleConns()
+	now := time.Now()
+	for _, entry := range p.pool {
+		if p.closed.Load() {
+			return
+		}
+		if !p.tryAcquire(entry) {
+			continue
+		}
+		switch {
+		case entry.conn == nil:
+		case p.expired(entry, now):
+			p.discard(entry)
+			idle--
+		case p.maxIdleTime > 0 && now.Sub(entry.idleSince) > p.maxIdleTime && idle > p.minIdle:
+			p.discard(entry)
+			idle--
+		case p.health.Interval > 0 && !p.healthy(entry.conn):
+			if p.redial(p.dialCtx, entry) != nil {
+				idle--
+			}
+		}
+		p.release(entry)
+	}
+
+	for _, entry := range p.pool {
+		if idle >= p.minIdle || p.closed.Load() {
+			return
+		}
+		if !p.tryAcquire(entry) {
+			continue
+		}
+		if entry.conn == nil {
+			if p.redial(p.dialCtx, entry) != nil {
+				// the next attempt is made in the next round
+				p.release(entry)
+				return
+			}
+			idle++
+		}
+		p.release(entry)
+	}
+}
+
+// tryAcquire acquires the idle entry without waiting
+func (p *Pool) tryAcquire(entry *poolEntry) bool {
+	if !p.clientWaiter.TryAcquire(1) {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&entry.acquired, 0, 1) {
+		p.clientWaiter.Release(1)
+		return false
+	}
+	return true
+}
+
+// idleConns counts the dialed connections that are not in use
+func (p *Pool) idleConns() int {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	idle := 0
+	for _, entry := range p.pool {
+		if entry.conn != nil && atomic.LoadInt32(&entry.acquired) == 0 {
+			idle++
+		}
+	}
+	return idle
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package connection
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// peerClosed peeks the socket without blocking. The peer closed
+// the connection if it reads EOF or fails with anything but EAGAIN
+func (c *Connection) peerClosed() bool {
+	sysConn, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return true
+	}
+	// the expired deadline of the last read fails the raw read at once
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return true
+	}
+	var closed bool
+	err = raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		closed = n == 0 && err == nil || err != nil && !errors.Is(err, syscall.EAGAIN)
+		return true
+	})
+	return closed || err != nil
+}
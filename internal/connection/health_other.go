@@ -0,0 +1,23 @@
+//go:build !linux
+
+package connection
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// peerClosed peeks the connection with the short deadline. The peer closed
+// the connection if the peek fails with anything but the timeout
+func (c *Connection) peerClosed() bool {
+	if err := c.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := c.buffer().Peek(1)
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
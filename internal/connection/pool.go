@@ -3,15 +3,86 @@ package connection
 import (
 	"context"
 	"errors"
-	"net"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Ghytro/easytcp/internal/algo"
 	"github.com/Ghytro/easytcp/internal/common"
 	"golang.org/x/sync/semaphore"
 )
 
+// ErrPoolClosed is returned once the pool is closed
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// ErrPoolQueueFull is returned when too many callers
+// are already waiting for the connection
+var ErrPoolQueueFull = errors.New("too many callers are waiting for the pool connection")
+
+// ErrPoolTimeout is matched with errors.Is by the PoolTimeoutError
+var ErrPoolTimeout = errors.New("timed out waiting for the pool connection")
+
+// PoolTimeoutError is returned when the context of the caller is done before
+// the connection is available. It unwraps to the error of the context
+type PoolTimeoutError struct {
+	// Waited is how long the caller waited for the connection
+	Waited time.Duration
+	Err    error
+}
+
+func (e *PoolTimeoutError) Error() string {
+	return fmt.Sprintf("waited %v for the pool connection: %v", e.Waited, e.Err)
+}
+
+func (e *PoolTimeoutError) Is(target error) bool {
+	return target == ErrPoolTimeout
+}
+
+func (e *PoolTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+type PoolConfig struct {
+	Address string
+
+	// Size is the maximum amount of connections in the pool. The connections
+	// are dialed once they're acquired, so the dial errors are returned then
+	Size int
+
+	// MinIdle is the amount of idle connections kept dialed in
+	// the background, so the acquired ones are ready at once
+	MinIdle int
+
+	// MaxIdleTime is the time after which the idle connection is
+	// closed, unless it's one of MinIdle. Zero means no limit
+	MaxIdleTime time.Duration
+
+	// MaxLifetime is the time after which the connection is closed and
+	// dialed again once it's idle, so the connections are rebalanced
+	// across the backends behind the address. Zero means no limit
+	MaxLifetime time.Duration
+
+	// MaxLifetimeJitter shortens the lifetime of every connection by the
+	// random amount up to it, so they are not rotated all at once.
+	// Defaults to the tenth of MaxLifetime
+	MaxLifetimeJitter time.Duration
+
+	// MaxWaiters limits the amount of callers waiting for the connection,
+	// the ones over the limit fail with ErrPoolQueueFull at once. Zero or
+	// less means no limit
+	MaxWaiters int
+
+	// HealthCheck configures validation of the pooled connections
+	HealthCheck HealthCheckConfig
+
+	// Reconnect configures redialing once the dial fails
+	Reconnect ReconnectConfig
+
+	// Conn configures every connection of the pool
+	Conn ConnectionConfig
+}
+
 type Pool struct {
 	connCfg      ConnectionConfig
 	address      string
@@ -20,59 +91,198 @@ type Pool struct {
 	clientWaiter *semaphore.Weighted
 	ctx          context.Context
 	maxSize      int
+	closed       atomic.Bool
+
+	maxWaiters int
+	waiters    atomic.Int64
+
+	minIdle        int
+	maxIdleTime    time.Duration
+	maxLifetime    time.Duration
+	lifetimeJitter time.Duration
+
+	health HealthCheckConfig
+	// stops the background maintenance once the pool is closed
+	done chan struct{}
+	// bounds the dials, cancelled once the pool is closed
+	dialCtx  context.Context
+	stopDial context.CancelFunc
+	// the maintenance and reconnect goroutines, awaited by Close
+	workers sync.WaitGroup
+
+	counters poolCounters
+
+	reconnect reconnect
 }
 
-func NewPool(ctx context.Context, address string, size int, connCfg ...ConnectionConfig) (*Pool, error) {
-	if size <= 0 {
+func NewPool(ctx context.Context, cfg PoolConfig) (*Pool, error) {
+	if cfg.Size <= 0 {
 		return nil, errors.New("it's strongly recommended to not create pool of non-fixed size")
 	}
-	if len(connCfg) == 0 {
-		connCfg = append(connCfg, DefaultConnectionConfig)
+	cfg.Conn.setDefault()
+	if cfg.MaxLifetimeJitter <= 0 {
+		cfg.MaxLifetimeJitter = cfg.MaxLifetime / 10
 	}
 
 	result := &Pool{
-		maxSize:      size,
-		address:      address,
-		connCfg:      connCfg[0],
-		poolLock:     &sync.Mutex{},
-		clientWaiter: semaphore.NewWeighted(int64(size)),
-		ctx:          ctx,
-	}
-	entries := make([]*poolEntry, size)
-	for i := 0; i < size; i++ {
-		conn, err := net.Dial("tcp", address)
-		if err != nil {
-			return nil, err
-		}
-		tcpConn := NewConnection(ctx, conn, connCfg[0])
-		entry := &poolEntry{
-			conn:     tcpConn,
-			acquired: 0,
-		}
-		entries[i] = entry
+		maxSize:        cfg.Size,
+		maxWaiters:     cfg.MaxWaiters,
+		address:        cfg.Address,
+		connCfg:        cfg.Conn,
+		poolLock:       &sync.Mutex{},
+		clientWaiter:   semaphore.NewWeighted(int64(cfg.Size)),
+		ctx:            ctx,
+		minIdle:        common.Min(cfg.MinIdle, cfg.Size),
+		maxIdleTime:    cfg.MaxIdleTime,
+		maxLifetime:    cfg.MaxLifetime,
+		lifetimeJitter: cfg.MaxLifetimeJitter,
+		health:         cfg.HealthCheck,
+		done:           make(chan struct{}),
+	}
+	result.dialCtx, result.stopDial = context.WithCancel(ctx)
+	result.connCfg.Counters = &result.counters.io
+	cfg.Reconnect.setDefault()
+	result.reconnect.ReconnectConfig = cfg.Reconnect
+	// the connections are dialed once they're needed
+	entries := make([]*poolEntry, cfg.Size)
+	for i := range entries {
+		entries[i] = &poolEntry{}
 	}
 	result.pool = entries
+	if result.maintained() {
+		result.workers.Add(1)
+		go result.maintainLoop()
+	}
 	return result, nil
 }
 
+// Acquire takes the free connection from the pool, waiting
+// for one while all of them are in use
 func (p *Pool) Acquire() (*Connection, error) {
-	if err := p.clientWaiter.Acquire(p.ctx, 1); err != nil {
-		return nil, err
+	return p.AcquireContext(context.Background())
+}
+
+// AcquireContext is the same as Acquire, but waits for the connection until
+// ctx is done, then *PoolTimeoutError is returned. The dial of the connection
+// is bounded by ctx as well. Fails with ErrPoolQueueFull at once if too many
+// callers are waiting already
+func (p *Pool) AcquireContext(ctx context.Context) (*Connection, error) {
+	start := time.Now()
+	for {
+		if p.closed.Load() {
+			return nil, ErrPoolClosed
+		}
+		if err := p.awaitReconnect(ctx); err != nil {
+			return nil, err
+		}
+		conn, err := p.acquire(ctx, start)
+		// the failed dial starts reconnecting, so
+		// the acquisition waits for it or fails fast
+		if err != nil && !errors.Is(err, ErrPoolTimeout) && p.reconnecting() {
+			continue
+		}
+		return conn, err
+	}
+}
+
+func (p *Pool) acquire(ctx context.Context, start time.Time) (*Connection, error) {
+	if !p.clientWaiter.TryAcquire(1) {
+		if err := p.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// the pool may be closed while waiting
+	if p.closed.Load() {
+		p.clientWaiter.Release(1)
+		return nil, ErrPoolClosed
 	}
 	p.poolLock.Lock()
-	defer p.poolLock.Unlock()
+	// the dialed connections are preferred
 	entry, ok := algo.Find(p.pool, func(entry *poolEntry) bool {
-		return atomic.CompareAndSwapInt32(&entry.acquired, 0, 1)
+		return entry.conn != nil && atomic.CompareAndSwapInt32(&entry.acquired, 0, 1)
 	})
 	if !ok {
+		entry, ok = algo.Find(p.pool, func(entry *poolEntry) bool {
+			return atomic.CompareAndSwapInt32(&entry.acquired, 0, 1)
+		})
+	}
+	p.poolLock.Unlock()
+	if !ok {
+		p.clientWaiter.Release(1)
 		return nil, errors.New("there are no available connections, try again later")
 	}
+	if err := p.prepare(ctx, entry); err != nil {
+		p.release(entry)
+		if err := ctxErr(ctx); err != nil {
+			return nil, &PoolTimeoutError{Waited: time.Since(start), Err: err}
+		}
+		return nil, err
+	}
 	return entry.conn, nil
 }
 
+// wait waits for the free slot of the pool until either the
+// context of the caller or the context of the pool is done
+func (p *Pool) wait(ctx context.Context) error {
+	if p.maxWaiters > 0 {
+		if p.waiters.Add(1) > int64(p.maxWaiters) {
+			p.waiters.Add(-1)
+			return ErrPoolQueueFull
+		}
+		defer p.waiters.Add(-1)
+	}
+
+	start := time.Now()
+	defer func() {
+		p.counters.waits.Add(1)
+		p.counters.waitTime.Add(int64(time.Since(start)))
+	}()
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer stop()
+	if err := p.clientWaiter.Acquire(waitCtx, 1); err != nil {
+		if ctx.Err() == nil {
+			return p.ctx.Err()
+		}
+		return &PoolTimeoutError{Waited: time.Since(start), Err: ctx.Err()}
+	}
+	return nil
+}
+
+// Release returns the connection to the pool. The connection failed
+// the health check or expired is closed and dialed before the next use
 func (p *Pool) Release(conn *Connection) error {
+	entry, err := p.entry(conn)
+	if err != nil {
+		return err
+	}
+	// the writes left in the batch are not meant for the next session
+	flushErr := conn.Flush()
+	if flushErr != nil || p.expired(entry, time.Now()) || p.health.OnReturn && !p.healthy(conn) {
+		p.discard(entry)
+	}
+	entry.idleSince = time.Now()
+	p.release(entry)
+	return flushErr
+}
+
+// Discard closes the broken connection and returns it to the
+// pool, so it's dialed again before the next use
+func (p *Pool) Discard(conn *Connection) error {
+	entry, err := p.entry(conn)
+	if err != nil {
+		return err
+	}
+	p.discard(entry)
+	p.release(entry)
+	return nil
+}
+
+// entry finds the entry of the acquired connection
+func (p *Pool) entry(conn *Connection) (*poolEntry, error) {
 	if conn == nil {
-		return common.WrapErr(errors.New("cannot release an empty connection"))
+		return nil, common.WrapErr(errors.New("cannot release an empty connection"))
 	}
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
@@ -80,14 +290,61 @@ func (p *Pool) Release(conn *Connection) error {
 		return entry.conn == conn
 	})
 	if !ok {
-		return common.WrapErr(errors.New("an error occured during pool connection release"))
+		return nil, common.WrapErr(errors.New("an error occured during pool connection release"))
 	}
+	return entry, nil
+}
+
+func (p *Pool) release(entry *poolEntry) {
 	atomic.StoreInt32(&entry.acquired, 0)
 	p.clientWaiter.Release(1)
-	return nil
+}
+
+// Close stops giving out the connections, waits for the acquired ones to be
+// released and closes all the connections. If ctx is done before, the acquired
+// connections are closed while in use and the error of ctx is returned.
+// Returns ErrPoolClosed if the pool is already closed
+func (p *Pool) Close(ctx context.Context) error {
+	if !p.closed.CompareAndSwap(false, true) {
+		return ErrPoolClosed
+	}
+	close(p.done)
+	// the background dials must not put the connections into
+	// the entries once they are closed, so they are stopped first
+	p.stopDial()
+	p.reconnect.mu.Lock()
+	p.reconnect.mu.Unlock()
+	p.workers.Wait()
+	waitErr := p.clientWaiter.Acquire(ctx, int64(p.maxSize))
+
+	p.poolLock.Lock()
+	var closeErr error
+	for _, entry := range p.pool {
+		if entry.conn == nil {
+			continue
+		}
+		if err := entry.conn.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	p.poolLock.Unlock()
+
+	if waitErr != nil {
+		return waitErr
+	}
+	// the sessions waiting for the connection fail once they get it
+	p.clientWaiter.Release(int64(p.maxSize))
+	return closeErr
 }
 
 type poolEntry struct {
 	acquired int32
-	conn     *Connection
+
+	// nil until the connection is dialed. Changed
+	// by the owner of the entry with the pool locked
+	conn *Connection
+
+	// owned by the one who acquired the entry
+	expiresAt time.Time
+	idleSince time.Time
 }
@@ -0,0 +1,209 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrReconnecting is returned from the acquisitions failed fast while
+// the pool is reconnecting. It's joined with the last dial error
+var ErrReconnecting = errors.New("connection pool is reconnecting")
+
+// ReconnectConfig configures redialing once the dial fails. The delay before
+// every attempt is random up to the backoff, that grows exponentially
+type ReconnectConfig struct {
+	// InitialBackoff is the backoff of the first attempt.
+	// Zero disables reconnecting, so every acquisition dials by itself
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the growth of the backoff. Defaults to 30 seconds
+	MaxBackoff time.Duration
+
+	// Multiplier is the growth of the backoff after every
+	// failed attempt. Defaults to 2
+	Multiplier float64
+
+	// MaxAttempts is the amount of attempts after which reconnecting gives up,
+	// the next acquisition starts it again. Zero means no limit
+	MaxAttempts int
+
+	// Wait makes the acquisitions wait for the reconnect until their context
+	// is done. By default they fail fast with ErrReconnecting
+	Wait bool
+}
+
+func (c *ReconnectConfig) setDefault() {
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = time.Second * 30
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = 2
+	}
+}
+
+// reconnect is the state of reconnecting of the pool
+type reconnect struct {
+	ReconnectConfig
+
+	mu     sync.Mutex
+	active bool
+	// the last dial error, returned once reconnecting gives up
+	err error
+	// closed once reconnecting is over
+	done chan struct{}
+}
+
+func (r *reconnect) enabled() bool {
+	return r.InitialBackoff > 0
+}
+
+// startReconnect starts redialing in the background,
+// unless it's disabled or started already
+func (p *Pool) startReconnect(err error) {
+	r := &p.reconnect
+	if !r.enabled() {
+		return
+	}
+	// Close observes the goroutine started under the lock
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active || p.closed.Load() {
+		return
+	}
+	r.active = true
+	r.err = err
+	r.done = make(chan struct{})
+	p.workers.Add(1)
+	go p.reconnectLoop()
+}
+
+func (p *Pool) reconnecting() bool {
+	r := &p.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active
+}
+
+// awaitReconnect fails fast with ErrReconnecting if the pool is reconnecting,
+// or waits for the reconnect if configured. Returns the last dial error if
+// reconnecting gave up
+func (p *Pool) awaitReconnect(ctx context.Context) error {
+	r := &p.reconnect
+	r.mu.Lock()
+	active, done, lastErr := r.active, r.done, r.err
+	r.mu.Unlock()
+	if !active {
+		return nil
+	}
+	if !r.Wait {
+		return fmt.Errorf("%w: %w", ErrReconnecting, lastErr)
+	}
+
+	start := time.Now()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return &PoolTimeoutError{Waited: time.Since(start), Err: ctx.Err()}
+	case <-p.done:
+		return ErrPoolClosed
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// reconnectLoop redials with the backoff until the dial succeeds or the attempts
+// are over. The dialed connection takes the empty entry, then all the idle
+// connections broken by the outage are redialed as well
+func (p *Pool) reconnectLoop() {
+	defer p.workers.Done()
+	r := &p.reconnect
+	backoff := r.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+		select {
+		case <-timer.C:
+		case <-p.done:
+			timer.Stop()
+			p.stopReconnect(ErrPoolClosed)
+			return
+		case <-p.ctx.Done():
+			timer.Stop()
+			p.stopReconnect(p.ctx.Err())
+			return
+		}
+
+		var conn *Connection
+		conn, err = p.dial(p.dialCtx)
+		if p.closed.Load() {
+			if conn != nil {
+				conn.Close()
+			}
+			p.stopReconnect(ErrPoolClosed)
+			return
+		}
+		if err == nil {
+			p.adopt(conn)
+			p.stopReconnect(nil)
+			p.reestablish()
+			return
+		}
+		// the fail fast acquisitions get the last error
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+		if r.MaxAttempts > 0 && attempt >= r.MaxAttempts {
+			p.stopReconnect(err)
+			return
+		}
+		backoff = time.Duration(float64(backoff) * r.Multiplier)
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+func (p *Pool) stopReconnect(err error) {
+	r := &p.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active = false
+	r.err = err
+	close(r.done)
+}
+
+// adopt puts the connection dialed by the reconnect into the empty entry
+func (p *Pool) adopt(conn *Connection) {
+	for _, entry := range p.pool {
+		if !p.tryAcquire(entry) {
+			continue
+		}
+		if entry.conn == nil {
+			// attach closes the connection if the pool is closed already
+			p.attach(entry, conn)
+			p.release(entry)
+			return
+		}
+		p.release(entry)
+	}
+	// all the entries are busy or dialed already
+	conn.Close()
+}
+
+// reestablish redials the idle connections closed by the peer
+func (p *Pool) reestablish() {
+	for _, entry := range p.pool {
+		if !p.tryAcquire(entry) {
+			continue
+		}
+		if entry.conn != nil && !entry.conn.Alive() {
+			p.redial(p.dialCtx, entry)
+		}
+		p.release(entry)
+	}
+}
@@ -0,0 +1,136 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/bufpool"
+	"github.com/Ghytro/easytcp/internal/common"
+)
+
+// sendFileChunk is the amount of bytes sent with a single write
+// deadline, so the large files are not bounded by the write timeout
+// as a whole, but the stalled transfer still fails
+const sendFileChunk = 4 << 20
+
+// SendFile writes n bytes of the file starting at offset. On linux tcp
+// connections the file is sent with sendfile(2) without copying it through
+// user space, otherwise it's copied. The offset of the file is not changed.
+// Every chunk of the file is bounded by the write timeout. The file sent
+// partially leaves the stream unusable, so the connection is closed then
+// even if it keeps open on timeouts
+func (c *Connection) SendFile(f *os.File, offset, n int64) (written int64, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	written, handled, err := c.sendFile(f, offset, n)
+	if !handled {
+		var copied int64
+		copied, err = c.copyFile(f, offset+written, n-written)
+		written += copied
+	}
+	if err != nil && written != 0 {
+		return written, common.NestedCloseConnErr(err, c.Close())
+	}
+	return written, err
+}
+
+// copyFile writes the part of the file through the pooled buffer
+func (c *Connection) copyFile(f *os.File, offset, n int64) (written int64, err error) {
+	buf := bufpool.Get(int(common.Min(n, sendFileChunk)))
+	defer bufpool.Put(buf)
+
+	r := io.NewSectionReader(f, offset, n)
+	for written < n {
+		m, readErr := io.ReadFull(r, buf[:common.Min(n-written, int64(len(buf)))])
+		if m != 0 {
+			w, err := c.write(nil, deadlineAfter(c.writeTimeout), buf[:m])
+			written += int64(w)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr != nil {
+			return written, fileErr(readErr)
+		}
+	}
+	return written, nil
+}
+
+// fileErr reports the file shorter than expected as io.ErrUnexpectedEOF
+func fileErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// PipeTo copies everything read from the connection to dst until EOF. On
+// linux tcp connections the data is spliced in the kernel without copying it
+// through user space. The data already buffered is written first. Neither
+// the read nor the write timeouts are applied, because the pipe may stay idle
+// for long. The writes to dst are blocked until the pipe is over
+func (c *Connection) PipeTo(dst *Connection) (written int64, err error) {
+	if n := c.Buffered(); n != 0 {
+		b, _ := c.buffer().Peek(n)
+		w, err := dst.Write(b)
+		c.buffer().Discard(w)
+		written += int64(w)
+		if err != nil {
+			return written, err
+		}
+	}
+	c.ReleaseBuffer()
+
+	dst.writeMu.Lock()
+	defer dst.writeMu.Unlock()
+	if err := dst.flushLocked(); err != nil {
+		return written, err
+	}
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return written, err
+	}
+	if err := dst.conn.SetWriteDeadline(time.Time{}); err != nil {
+		return written, err
+	}
+	n, err := io.Copy(dst.conn, c.conn)
+	c.countRead(n)
+	dst.countWritten(n)
+	return written + n, err
+}
+
+// Proxy pipes the connections into each other until either of them is
+// closed by the peer, then both of them are closed
+func Proxy(a, b *Connection) error {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.PipeTo(a)
+		closeBoth()
+		errs <- err
+	}()
+	_, err := a.PipeTo(b)
+	closeBoth()
+	if bErr := <-errs; err == nil || errors.Is(err, net.ErrClosed) {
+		err = bErr
+	}
+	// the pipe interrupted by closing is not an error
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
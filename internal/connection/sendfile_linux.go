@@ -0,0 +1,71 @@
+//go:build linux
+
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Ghytro/easytcp/internal/common"
+)
+
+// sendFile sends the file with sendfile(2). Reports false if the connection
+// or the file doesn't support it and nothing was sent, so the file should be copied
+func (c *Connection) sendFile(f *os.File, offset, n int64) (written int64, handled bool, err error) {
+	// the wrapped connections like TLS ones need the data in user space
+	tcpConn, ok := c.conn.(*net.TCPConn)
+	if !ok || n <= 0 {
+		return 0, false, nil
+	}
+	dst, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	src, err := f.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	controlErr := src.Control(func(srcFd uintptr) {
+		for written < n {
+			if err = c.conn.SetWriteDeadline(deadlineAfter(c.writeTimeout)); err != nil {
+				return
+			}
+			chunk := int(common.Min(n-written, sendFileChunk))
+			var (
+				sent    int
+				sendErr error
+			)
+			err = dst.Write(func(dstFd uintptr) bool {
+				sent, sendErr = syscall.Sendfile(int(dstFd), int(srcFd), &offset, chunk)
+				return !errors.Is(sendErr, syscall.EAGAIN)
+			})
+			if sent > 0 {
+				written += int64(sent)
+				c.countWritten(int64(sent))
+			}
+			switch {
+			case err != nil:
+				err = c.ioErr(nil, err)
+				return
+			case sendErr != nil:
+				err = sendErr
+				return
+			case sent == 0:
+				err = io.ErrUnexpectedEOF
+				return
+			}
+		}
+	})
+	if controlErr != nil {
+		return written, written != 0, controlErr
+	}
+	// the file systems not supporting sendfile fail before sending anything
+	if written == 0 && (errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS)) {
+		return 0, false, nil
+	}
+	return written, true, err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package connection
+
+import "os"
+
+// sendFile is only implemented on linux, the file is copied on other platforms
+func (c *Connection) sendFile(f *os.File, offset, n int64) (written int64, handled bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,137 @@
+package connection
+
+import (
+	"net"
+	"time"
+)
+
+// SocketOptions tunes the tcp socket of the connection. The zero
+// fields leave the system defaults. The options marked as linux
+// only are ignored on the other platforms
+type SocketOptions struct {
+	// Nagle enables the Nagle's algorithm, so the small writes are delayed
+	// to be coalesced. By default TCP_NODELAY is set and the writes go at once
+	Nagle bool
+
+	// KeepAliveIdle is the time the connection stays idle before the first
+	// keepalive probe. Negative disables the keepalive probes
+	KeepAliveIdle time.Duration
+
+	// KeepAliveInterval is the time between the keepalive probes. Linux only
+	KeepAliveInterval time.Duration
+
+	// KeepAliveCount is the amount of the unanswered keepalive probes
+	// after which the connection is dropped. Linux only
+	KeepAliveCount int
+
+	// UserTimeout is the longest time the sent data may stay
+	// unacknowledged before the connection is dropped. Linux only
+	UserTimeout time.Duration
+
+	// Linger is the time Close blocks sending the pending data. Negative
+	// makes Close discard the pending data and reset the connection
+	Linger time.Duration
+
+	// SendBuffer and RecvBuffer are the sizes of the kernel socket buffers
+	SendBuffer int
+	RecvBuffer int
+
+	// QuickAck disables the delayed acknowledgements. The kernel may
+	// turn it off again, so it's only a hint. Linux only
+	QuickAck bool
+
+	// NotSentLowat limits the amount of the unsent data in the send buffer,
+	// so the writes block earlier instead of queueing the data. Linux only
+	NotSentLowat int
+
+	// TOS is the IP type of service, or the traffic class on IPv6.
+	// DSCP takes its upper six bits, so it's set as dscp<<2. Linux only
+	TOS int
+}
+
+// SetSocketOptions applies the options to the connection. Does nothing
+// if the connection is not the tcp one
+func SetSocketOptions(conn net.Conn, opts SocketOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if opts.Nagle {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if opts.KeepAliveIdle < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	}
+	if opts.Linger != 0 {
+		if err := tcpConn.SetLinger(lingerSeconds(opts.Linger)); err != nil {
+			return err
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.RecvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(opts.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	return setPlatformOptions(tcpConn, opts)
+}
+
+// lingerSeconds rounds the positive linger up to the seconds,
+// the negative one becomes zero, that resets the connection on close
+func lingerSeconds(linger time.Duration) int {
+	if linger < 0 {
+		return 0
+	}
+	return roundSeconds(linger)
+}
+
+// roundSeconds rounds the duration up to the whole seconds
+func roundSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// TCPInfo is the kernel statistics of the tcp connection
+type TCPInfo struct {
+	// RTT is the smoothed round trip time and RTTVar is its variance
+	RTT    time.Duration
+	RTTVar time.Duration
+
+	// Retransmits is the amount of the retransmits of the unacknowledged
+	// segment in a row, TotalRetrans is the amount over the connection lifetime
+	Retransmits  uint32
+	TotalRetrans uint32
+
+	// Lost is the amount of the segments considered lost
+	// and Unacked is the amount of the segments in flight
+	Lost    uint32
+	Unacked uint32
+
+	// SendMSS and RecvMSS are the maximum segment sizes
+	SendMSS uint32
+	RecvMSS uint32
+
+	// SendCwnd is the congestion window in segments
+	SendCwnd uint32
+}
+
+// SocketOptions reads back the effective options of the socket. They may
+// differ from the applied ones, for example linux doubles the buffer sizes.
+// Returns errors.ErrUnsupported if the platform or the connection doesn't
+// allow reading them
+func (c *Connection) SocketOptions() (SocketOptions, error) {
+	return getSocketOptions(c.conn)
+}
+
+// TCPInfo returns the kernel statistics of the connection. Returns
+// errors.ErrUnsupported if the platform or the connection doesn't provide them
+func (c *Connection) TCPInfo() (TCPInfo, error) {
+	return getTCPInfo(c.conn)
+}
@@ -0,0 +1,178 @@
+//go:build linux
+
+package connection
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// not defined by syscall
+const (
+	tcpUserTimeout  = 0x12
+	tcpNotSentLowat = 0x19
+)
+
+func setPlatformOptions(conn *net.TCPConn, opts SocketOptions) error {
+	var ints []sockoptInt
+	if opts.KeepAliveIdle > 0 || opts.KeepAliveInterval > 0 || opts.KeepAliveCount > 0 {
+		ints = append(ints, sockoptInt{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1})
+	}
+	if opts.KeepAliveIdle > 0 {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, roundSeconds(opts.KeepAliveIdle)})
+	}
+	if opts.KeepAliveInterval > 0 {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, roundSeconds(opts.KeepAliveInterval)})
+	}
+	if opts.KeepAliveCount > 0 {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, opts.KeepAliveCount})
+	}
+	if opts.UserTimeout > 0 {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, tcpUserTimeout, int(opts.UserTimeout / time.Millisecond)})
+	}
+	if opts.QuickAck {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1})
+	}
+	if opts.NotSentLowat > 0 {
+		ints = append(ints, sockoptInt{syscall.IPPROTO_TCP, tcpNotSentLowat, opts.NotSentLowat})
+	}
+	if opts.TOS > 0 {
+		level, opt := tosOption(conn)
+		ints = append(ints, sockoptInt{level, opt, opts.TOS})
+	}
+	if len(ints) == 0 {
+		return nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := raw.Control(func(fd uintptr) {
+		for _, o := range ints {
+			if err = syscall.SetsockoptInt(int(fd), o.level, o.opt, o.value); err != nil {
+				return
+			}
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+type sockoptInt struct {
+	level, opt, value int
+}
+
+// tosOption returns the type of service option of the address family of the socket
+func tosOption(conn *net.TCPConn) (level, opt int) {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	return syscall.IPPROTO_IP, syscall.IP_TOS
+}
+
+func getSocketOptions(conn net.Conn) (opts SocketOptions, err error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return opts, errors.ErrUnsupported
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return opts, err
+	}
+	tosLevel, tosOpt := tosOption(tcpConn)
+	controlErr := raw.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			if err != nil {
+				return 0
+			}
+			var value int
+			value, err = syscall.GetsockoptInt(int(fd), level, opt)
+			return value
+		}
+		opts.Nagle = get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0
+		if get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+			opts.KeepAliveIdle = -1
+		} else {
+			opts.KeepAliveIdle = time.Duration(get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)) * time.Second
+		}
+		opts.KeepAliveInterval = time.Duration(get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)) * time.Second
+		opts.KeepAliveCount = get(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+		opts.UserTimeout = time.Duration(get(syscall.IPPROTO_TCP, tcpUserTimeout)) * time.Millisecond
+		opts.SendBuffer = get(syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		opts.RecvBuffer = get(syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		opts.QuickAck = get(syscall.IPPROTO_TCP, syscall.TCP_QUICKACK) != 0
+		opts.NotSentLowat = get(syscall.IPPROTO_TCP, tcpNotSentLowat)
+		opts.TOS = get(tosLevel, tosOpt)
+		if err != nil {
+			return
+		}
+
+		var linger syscall.Linger
+		if err = getsockopt(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, unsafe.Pointer(&linger), unsafe.Sizeof(linger)); err != nil {
+			return
+		}
+		switch {
+		case linger.Onoff == 0:
+		case linger.Linger == 0:
+			opts.Linger = -1
+		default:
+			opts.Linger = time.Duration(linger.Linger) * time.Second
+		}
+	})
+	if controlErr != nil {
+		return opts, controlErr
+	}
+	return opts, err
+}
+
+func getTCPInfo(conn net.Conn) (TCPInfo, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return TCPInfo{}, errors.ErrUnsupported
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return TCPInfo{}, err
+	}
+	var info syscall.TCPInfo
+	controlErr := raw.Control(func(fd uintptr) {
+		err = getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&info), unsafe.Sizeof(info))
+	})
+	if controlErr != nil {
+		return TCPInfo{}, controlErr
+	}
+	if err != nil {
+		return TCPInfo{}, err
+	}
+	return TCPInfo{
+		RTT:          time.Duration(info.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(info.Rttvar) * time.Microsecond,
+		Retransmits:  uint32(info.Retransmits),
+		TotalRetrans: info.Total_retrans,
+		Lost:         info.Lost,
+		Unacked:      info.Unacked,
+		SendMSS:      info.Snd_mss,
+		RecvMSS:      info.Rcv_mss,
+		SendCwnd:     info.Snd_cwnd,
+	}, nil
+}
+
+// getsockopt reads the option of the arbitrary type,
+// the older kernels may fill less than size bytes
+func getsockopt(fd uintptr, level, opt int, value unsafe.Pointer, size uintptr) error {
+	n := uint32(size)
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt),
+		uintptr(value), uintptr(unsafe.Pointer(&n)), 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
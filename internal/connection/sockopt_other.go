@@ -0,0 +1,28 @@
+//go:build !linux
+
+package connection
+
+import (
+	"errors"
+	"net"
+)
+
+// setPlatformOptions applies the keepalive idle time, the
+// other linux only options are ignored on this platform
+func setPlatformOptions(conn *net.TCPConn, opts SocketOptions) error {
+	if opts.KeepAliveIdle > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return conn.SetKeepAlivePeriod(opts.KeepAliveIdle)
+	}
+	return nil
+}
+
+func getSocketOptions(conn net.Conn) (SocketOptions, error) {
+	return SocketOptions{}, errors.ErrUnsupported
+}
+
+func getTCPInfo(conn net.Conn) (TCPInfo, error) {
+	return TCPInfo{}, errors.ErrUnsupported
+}
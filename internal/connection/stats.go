@@ -0,0 +1,95 @@
+package connection
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// IOCounters counts the bytes transferred by all the connections sharing it
+type IOCounters struct {
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+func (s *IOCounters) BytesRead() uint64 {
+	return s.read.Load()
+}
+
+func (s *IOCounters) BytesWritten() uint64 {
+	return s.written.Load()
+}
+
+func (c *Connection) countRead(n int64) {
+	if c.counters != nil && n > 0 {
+		c.counters.read.Add(uint64(n))
+	}
+}
+
+func (c *Connection) countWritten(n int64) {
+	if c.counters != nil && n > 0 {
+		c.counters.written.Add(uint64(n))
+	}
+}
+
+// PoolStats is the snapshot of the pool metrics. The counters
+// are cumulative over the pool lifetime
+type PoolStats struct {
+	// TotalConns is the amount of the dialed connections,
+	// IdleConns of them are free and InUseConns are acquired
+	TotalConns int
+	IdleConns  int
+	InUseConns int
+
+	// WaitCount is the amount of the acquisitions that waited for the
+	// connection to be released, WaitDuration is the total time they waited
+	WaitCount    uint64
+	WaitDuration time.Duration
+
+	Dials      uint64
+	DialErrors uint64
+
+	// Discarded is the amount of the connections closed by the pool
+	// because they were broken, expired or idle for too long
+	Discarded uint64
+
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// poolCounters are the cumulative metrics of the pool
+type poolCounters struct {
+	waits      atomic.Uint64
+	waitTime   atomic.Int64
+	dials      atomic.Uint64
+	dialErrors atomic.Uint64
+	discarded  atomic.Uint64
+	io         IOCounters
+}
+
+// Stats returns the snapshot of the pool metrics. It only locks
+// the pool to count the connections, so it can be polled often
+func (p *Pool) Stats() PoolStats {
+	stats := PoolStats{
+		WaitCount:    p.counters.waits.Load(),
+		WaitDuration: time.Duration(p.counters.waitTime.Load()),
+		Dials:        p.counters.dials.Load(),
+		DialErrors:   p.counters.dialErrors.Load(),
+		Discarded:    p.counters.discarded.Load(),
+		BytesRead:    p.counters.io.BytesRead(),
+		BytesWritten: p.counters.io.BytesWritten(),
+	}
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	for _, entry := range p.pool {
+		if entry.conn == nil {
+			continue
+		}
+		stats.TotalConns++
+		if atomic.LoadInt32(&entry.acquired) == 0 {
+			stats.IdleConns++
+		} else {
+			stats.InUseConns++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,83 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode classifies the error sent in the error frame.
+// The codes below 100 are reserved by easytcp
+type ErrorCode uint32
+
+const (
+	CodeUnknown ErrorCode = iota
+
+	// CodeInternal is used for the errors that have no wire representation
+	CodeInternal
+
+	// CodeBadRequest means that the request frame is malformed
+	CodeBadRequest
+
+	// CodeNotAllowed means that the message is not allowed
+	// in the current state of the connection
+	CodeNotAllowed
+
+	// CodeDeadlineExceeded means that the request
+	// was not handled before its deadline
+	CodeDeadlineExceeded
+)
+
+var errMalformed = errors.New("malformed error frame")
+
+// Error is an error sent in the error frame. The payload of the error frame is:
+//
+//	+--------+----------------+---------+---------+
+//	| code   | message length | message | details |
+//	| uint32 | uint32         |         |         |
+//	+--------+----------------+---------+---------+
+type Error struct {
+	Code    ErrorCode
+	Message string
+
+	// Details carry any additional application-defined data
+	Details []byte
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("easytcp: remote error %d: %s", e.Code, e.Message)
+}
+
+// Frame encodes the error into the error frame with the given id
+func (e *Error) Frame(id uint64) Frame {
+	payload := make([]byte, 8, 8+len(e.Message)+len(e.Details))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(e.Code))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(len(e.Message)))
+	payload = append(payload, e.Message...)
+	payload = append(payload, e.Details...)
+	return Frame{
+		ID:      id,
+		Flags:   FlagError,
+		Payload: payload,
+	}
+}
+
+// DecodeError decodes the payload of the error frame
+func DecodeError(payload []byte) (*Error, error) {
+	if len(payload) < 8 {
+		return nil, errMalformed
+	}
+	msgLen := binary.BigEndian.Uint32(payload[4:8])
+	if uint64(msgLen) > uint64(len(payload)-8) {
+		return nil, errMalformed
+	}
+	e := &Error{
+		Code:    ErrorCode(binary.BigEndian.Uint32(payload[0:4])),
+		Message: string(payload[8 : 8+msgLen]),
+	}
+	if details := payload[8+msgLen:]; len(details) != 0 {
+		// the payload may be reused once the frame is released
+		e.Details = append([]byte(nil), details...)
+	}
+	return e, nil
+}
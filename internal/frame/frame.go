@@ -0,0 +1,114 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HeaderSize is the size of the fixed frame header:
+//
+//	+----------------+-------+----------+-------------------+---------+
+//	| payload length | flags | id       | optional fields   | payload |
+//	| uint32         | uint8 | uint64   | defined by flags  |         |
+//	+----------------+-------+----------+-------------------+---------+
+//
+// All the integers are big endian. The optional fields
+// follow the fixed header in the order of their flags
+const HeaderSize = 4 + 1 + 8
+
+// timeoutSize is the size of the optional timeout field, which
+// is the amount of nanoseconds given to handle the frame
+const timeoutSize = 8
+
+// DefaultMaxSize is the default limit of the frame payload size
+const DefaultMaxSize = 16 << 20
+
+var ErrTooLarge = errors.New("frame payload is too large")
+
+// Flags describe the frame and its optional header fields
+type Flags uint8
+
+const (
+	// FlagTimeout means that the header carries the timeout field
+	FlagTimeout Flags = 1 << iota
+
+	// FlagError means that the payload is the encoded Error
+	FlagError
+
+	// FlagPush means that the frame is pushed by the server on its own
+	// rather than replies to the request, so its id is meaningless
+	FlagPush
+)
+
+// Frame is a single message of the easytcp framed protocol
+type Frame struct {
+	// ID correlates the request frame with its response frame
+	ID uint64
+
+	Flags Flags
+
+	// Timeout is the time the sender gives the receiver to handle
+	// the frame. Zero means that the frame has no timeout
+	Timeout time.Duration
+
+	Payload []byte
+}
+
+// HeaderLen returns the size of the header with
+// the optional fields defined by the flags
+func HeaderLen(flags Flags) int {
+	if flags&FlagTimeout != 0 {
+		return HeaderSize + timeoutSize
+	}
+	return HeaderSize
+}
+
+// ParseHeader decodes the header of HeaderLen size. Returns the frame without
+// payload and the size of the payload, which is checked against maxSize
+func ParseHeader(header []byte, maxSize int) (Frame, int, error) {
+	size := binary.BigEndian.Uint32(header[0:4])
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if uint64(size) > uint64(maxSize) {
+		return Frame{}, 0, fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, size, maxSize)
+	}
+	f := Frame{
+		Flags: Flags(header[4]),
+		ID:    binary.BigEndian.Uint64(header[5:13]),
+	}
+	if f.Flags&FlagTimeout != 0 {
+		f.Timeout = time.Duration(binary.BigEndian.Uint64(header[HeaderSize : HeaderSize+timeoutSize]))
+	}
+	return f, int(size), nil
+}
+
+// Append appends the encoded frame to dst and returns the extended slice
+func Append(dst []byte, f Frame) []byte {
+	f.Flags &^= FlagTimeout
+	if f.Timeout > 0 {
+		f.Flags |= FlagTimeout
+	}
+
+	var header [HeaderSize + timeoutSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(f.Payload)))
+	header[4] = byte(f.Flags)
+	binary.BigEndian.PutUint64(header[5:13], f.ID)
+	n := HeaderSize
+	if f.Flags&FlagTimeout != 0 {
+		binary.BigEndian.PutUint64(header[n:n+timeoutSize], uint64(f.Timeout))
+		n += timeoutSize
+	}
+	dst = append(dst, header[:n]...)
+	return append(dst, f.Payload...)
+}
+
+// Size returns the size of the encoded frame
+func Size(f Frame) int {
+	if f.Timeout > 0 {
+		return HeaderSize + timeoutSize + len(f.Payload)
+	}
+	return HeaderSize + len(f.Payload)
+}
@@ -0,0 +1,161 @@
+package sched
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrClosed = errors.New("scheduler is closed")
+
+// Scheduler executes the tasks submitted to its queues on a fixed amount
+// of workers. The queues having tasks are served in weighted round-robin
+// order: every queue runs up to its weight of tasks, then goes to the end
+// of the line. The total amount of queued tasks is bounded, so Submit blocks
+// the caller until the workers catch up
+type Scheduler struct {
+	mu       sync.Mutex
+	hasWork  *sync.Cond
+	hasSpace *sync.Cond
+
+	// queues having tasks, in the order they are served
+	ready []*Queue
+
+	queued   int
+	capacity int
+	closed   bool
+
+	workers sync.WaitGroup
+}
+
+func New(workers, capacity int) *Scheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+	if capacity <= 0 {
+		capacity = workers
+	}
+	s := &Scheduler{capacity: capacity}
+	s.hasWork = sync.NewCond(&s.mu)
+	s.hasSpace = sync.NewCond(&s.mu)
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// NewQueue creates the queue with the given share of workers. Weight
+// is the amount of tasks the queue runs in a row when it's its turn
+func (s *Scheduler) NewQueue(weight int) *Queue {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Queue{
+		s:      s,
+		weight: weight,
+	}
+}
+
+// Close stops accepting new tasks and waits for the queued ones to finish
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.hasWork.Broadcast()
+	s.hasSpace.Broadcast()
+	s.workers.Wait()
+}
+
+func (s *Scheduler) work() {
+	defer s.workers.Done()
+	for {
+		task, ok := s.next()
+		if !ok {
+			return
+		}
+		task()
+	}
+}
+
+// next blocks until there is a task to run. Returns false
+// when the scheduler is closed and all the tasks are done
+func (s *Scheduler) next() (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.ready) == 0 && !s.closed {
+		s.hasWork.Wait()
+	}
+	if len(s.ready) == 0 {
+		return nil, false
+	}
+
+	q := s.ready[0]
+	task := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	q.credit--
+	s.queued--
+	s.hasSpace.Signal()
+
+	switch {
+	case len(q.tasks) == 0:
+		q.ready = false
+		s.ready = s.ready[1:]
+	case q.credit == 0:
+		q.credit = q.weight
+		s.ready = append(s.ready[1:], q)
+	}
+	return task, true
+}
+
+// Queue is the line of tasks of a single consumer, such as a connection.
+// The tasks of the same queue run in the order they were submitted, but
+// may run concurrently when there are several free workers
+type Queue struct {
+	s      *Scheduler
+	weight int
+
+	// tasks left to run in the current turn
+	credit int
+	tasks  []func()
+
+	// ready is set when the queue waits for its turn
+	ready bool
+}
+
+// Submit enqueues the task. Blocks while the scheduler is full
+func (q *Queue) Submit(task func()) error {
+	s := q.s
+	s.mu.Lock()
+	for s.queued >= s.capacity && !s.closed {
+		s.hasSpace.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	q.tasks = append(q.tasks, task)
+	s.queued++
+	if !q.ready {
+		q.ready = true
+		q.credit = q.weight
+		s.ready = append(s.ready, q)
+	}
+	s.mu.Unlock()
+	s.hasWork.Signal()
+	return nil
+}
+
+// Do enqueues the task and waits until it's done
+func (q *Queue) Do(task func()) error {
+	done := make(chan struct{})
+	err := q.Submit(func() {
+		defer close(done)
+		task()
+	})
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,80 @@
+package easytcp
+
+import "github.com/Ghytro/easytcp/internal/common"
+
+// KeyScope defines the lifetime of the value stored by Key
+type KeyScope int
+
+const (
+	// ScopeConnection values live until the connection is closed
+	// and are shared by all the messages of the connection
+	ScopeConnection KeyScope = iota
+
+	// ScopeMessage values live until the message is handled
+	// and are only visible to the handlers of this message
+	ScopeMessage
+)
+
+// keyID identifies the key by pointer, so two keys
+// with the same name never collide
+type keyID struct {
+	name string
+}
+
+// Key is a typed key of the value stored in ServerContext. The zero Key
+// is not usable, keys must be created with NewKey or NewMessageKey.
+// Declare keys once as package-level variables:
+//
+//	var UserKey = easytcp.NewKey[*User]("user")
+//
+//	UserKey.Set(ctx, user)
+//	user, ok := UserKey.Get(ctx)
+type Key[T any] struct {
+	id    *keyID
+	scope KeyScope
+}
+
+// NewKey creates the key of the connection-scoped value.
+// The name is only used for debugging purposes
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{
+		id:    &keyID{name: name},
+		scope: ScopeConnection,
+	}
+}
+
+// NewMessageKey creates the key of the message-scoped value.
+// The name is only used for debugging purposes
+func NewMessageKey[T any](name string) Key[T] {
+	return Key[T]{
+		id:    &keyID{name: name},
+		scope: ScopeMessage,
+	}
+}
+
+func (k Key[T]) Name() string {
+	return k.id.name
+}
+
+func (k Key[T]) Scope() KeyScope {
+	return k.scope
+}
+
+// Get retreives the value from context. Returns false if the value is not set
+func (k Key[T]) Get(ctx *ServerContext) (T, bool) {
+	return common.GetAs[T](ctx.store(k.scope), k.id)
+}
+
+// Value retreives the value from context. Returns the zero value if the value is not set
+func (k Key[T]) Value(ctx *ServerContext) T {
+	result, _ := k.Get(ctx)
+	return result
+}
+
+func (k Key[T]) Set(ctx *ServerContext, value T) {
+	ctx.store(k.scope).Set(k.id, value)
+}
+
+func (k Key[T]) Delete(ctx *ServerContext) {
+	ctx.store(k.scope).Delete(k.id)
+}
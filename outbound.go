@@ -0,0 +1,256 @@
+package easytcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/Ghytro/easytcp/internal/bufpool"
+	"github.com/Ghytro/easytcp/internal/frame"
+)
+
+// ErrSlowConsumer is the error the connection is closed with when its
+// outbound queue is full and the policy is SlowConsumerDisconnect
+var ErrSlowConsumer = errors.New("outbound queue is full, client is too slow")
+
+// ErrOutboundDropped is returned from SendAsync when the message
+// is dropped because of SlowConsumerDropNewest policy
+var ErrOutboundDropped = errors.New("outbound queue is full, message is dropped")
+
+// SlowConsumerPolicy tells what to do when the outbound
+// queue of the connection is full
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock blocks SendAsync until there is free space in the queue
+	SlowConsumerBlock SlowConsumerPolicy = iota
+
+	// SlowConsumerDropOldest drops the oldest message in the queue
+	// to free the space for the new one
+	SlowConsumerDropOldest
+
+	// SlowConsumerDropNewest drops the message being sent
+	SlowConsumerDropNewest
+
+	// SlowConsumerDisconnect closes the connection with ErrSlowConsumer
+	SlowConsumerDisconnect
+)
+
+type OutboundConfig struct {
+	// QueueSize is the maximum amount of messages
+	// waiting to be sent by the connection writer
+	QueueSize int
+
+	// Policy applied when the queue is full
+	Policy SlowConsumerPolicy
+}
+
+// OutboundStats describes the outbound queues
+type OutboundStats struct {
+	// Depth is the amount of messages waiting in the queue
+	Depth int
+
+	// Dropped is the amount of messages dropped by the policy
+	Dropped uint64
+}
+
+// SendAsync queues the message to be sent to the client by the writer of
+// the connection. Unlike the other methods of ServerContext, it's safe for
+// concurrent use, so the messages can be pushed to the client from outside
+// of its handlers. In framed mode every message is sent in a frame with zero
+// id and FrameFlagPush, so the client tells it from the responses. In stream
+// mode the message is never interleaved with a single send of the handlers,
+// but may be sent between two of them. Returns net.ErrClosed once the
+// connection is closed
+func (ctx *ServerContext) SendAsync(b []byte) error {
+	return ctx.outbound.push(b)
+}
+
+// OutboundStats returns the metrics of the outbound queue of the connection
+func (ctx *ServerContext) OutboundStats() OutboundStats {
+	return ctx.outbound.stats()
+}
+
+// OutboundStats returns the metrics of the outbound queues of all the connections
+func (s *Server) OutboundStats() OutboundStats {
+	return OutboundStats{
+		Depth:   int(s.outboundDepth.Load()),
+		Dropped: s.outboundDropped.Load(),
+	}
+}
+
+// outbound is the queue of the messages sent with SendAsync. The writer
+// goroutine is started once the message is queued and exits once the queue
+// is empty, so the idle connections don't hold it
+type outbound struct {
+	server *Server
+	sCtx   *ServerContext
+
+	mu      sync.Mutex
+	notFull *sync.Cond
+
+	// ring of the pooled copies of the messages,
+	// allocated once the first message is queued
+	ring [][]byte
+	head int
+	n    int
+
+	dropped uint64
+	closed  bool
+
+	// no more messages are accepted, but the queued ones are still sent
+	finished bool
+
+	// if the connection was closed because of the full queue
+	slow bool
+
+	running bool
+	writer  sync.WaitGroup
+}
+
+func newOutbound(sCtx *ServerContext) *outbound {
+	o := &outbound{
+		server: sCtx.server,
+		sCtx:   sCtx,
+	}
+	o.notFull = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *outbound) push(b []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ring == nil {
+		o.ring = make([][]byte, o.server.outbound.QueueSize)
+	}
+
+	for !o.closed && o.n == len(o.ring) {
+		switch o.server.outbound.Policy {
+		case SlowConsumerDropOldest:
+			bufpool.Put(o.pop())
+			o.drop()
+		case SlowConsumerDropNewest:
+			o.drop()
+			return ErrOutboundDropped
+		case SlowConsumerDisconnect:
+			o.slow = true
+			o.sCtx.conn.Close()
+			return ErrSlowConsumer
+		default:
+			o.notFull.Wait()
+		}
+	}
+	if o.closed || o.finished {
+		return net.ErrClosed
+	}
+
+	msg := bufpool.Get(len(b))
+	copy(msg, b)
+	o.ring[(o.head+o.n)%len(o.ring)] = msg
+	o.n++
+	o.server.outboundDepth.Add(1)
+
+	if !o.running {
+		o.running = true
+		o.writer.Add(1)
+		go o.write()
+	}
+	return nil
+}
+
+// pop removes the oldest message from the queue. Must be called with mu locked
+func (o *outbound) pop() []byte {
+	msg := o.ring[o.head]
+	o.ring[o.head] = nil
+	o.head = (o.head + 1) % len(o.ring)
+	o.n--
+	o.server.outboundDepth.Add(-1)
+	return msg
+}
+
+func (o *outbound) drop() {
+	o.dropped++
+	o.server.outboundDropped.Add(1)
+}
+
+// write sends the queued messages until the queue is empty
+func (o *outbound) write() {
+	defer o.writer.Done()
+	conn := o.sCtx.conn
+	for {
+		o.mu.Lock()
+		if o.closed || o.n == 0 {
+			o.running = false
+			o.mu.Unlock()
+			return
+		}
+		msg := o.pop()
+		o.notFull.Signal()
+		last := o.n == 0
+		o.mu.Unlock()
+
+		var err error
+		if o.server.framed {
+			err = conn.WriteFrame(frame.Frame{Flags: frame.FlagPush, Payload: msg})
+		} else {
+			_, err = conn.Write(msg)
+		}
+		bufpool.Put(msg)
+		if err == nil && last {
+			err = conn.Flush()
+		}
+		if err != nil {
+			// the connection is closed by the failed write,
+			// so the disconnect handler is called anyway
+			o.close()
+			return
+		}
+	}
+}
+
+// close drops the queued messages and unblocks the senders
+func (o *outbound) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	for o.n != 0 {
+		bufpool.Put(o.pop())
+	}
+	o.notFull.Broadcast()
+}
+
+// finish stops accepting the messages and waits
+// for the queued ones to be sent
+func (o *outbound) finish() {
+	o.mu.Lock()
+	o.finished = true
+	o.mu.Unlock()
+	o.writer.Wait()
+}
+
+// shutdown closes the queue and waits for the writer to exit
+func (o *outbound) shutdown() {
+	o.close()
+	o.writer.Wait()
+}
+
+func (o *outbound) slowConsumerErr() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.slow {
+		return ErrSlowConsumer
+	}
+	return nil
+}
+
+func (o *outbound) stats() OutboundStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return OutboundStats{
+		Depth:   o.n,
+		Dropped: o.dropped,
+	}
+}
@@ -0,0 +1,205 @@
+package easytcp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Ghytro/easytcp/internal/bufpool"
+	"github.com/Ghytro/easytcp/internal/frame"
+)
+
+// ResponseOrder defines the order the responses
+// to pipelined frames are sent to client
+type ResponseOrder int
+
+const (
+	// ResponseOrderRequest sends the responses in the same order the
+	// requests arrived, so a slow request delays the responses behind it
+	ResponseOrderRequest ResponseOrder = iota
+
+	// ResponseOrderCorrelated sends every response as soon as it's ready.
+	// The client matches responses to requests by the frame id
+	ResponseOrderCorrelated
+)
+
+type PipelineConfig struct {
+	// MaxInFlight is the maximum amount of frames of a single connection
+	// handled concurrently. The server stops reading ahead when there are
+	// MaxInFlight frames not responded yet. Zero or one means that the
+	// frames are handled one by one
+	MaxInFlight int
+
+	// Order of the responses to pipelined frames
+	Order ResponseOrder
+}
+
+// pipeline handles the frames of a single connection concurrently.
+// Frames are read by the connection goroutine, handled in their own
+// goroutines or in the worker pool and responded by the dedicated
+// writer goroutine
+type pipeline struct {
+	connCtx *ServerContext
+	order   ResponseOrder
+
+	// slots bounds the amount of frames read but not responded yet
+	slots   chan struct{}
+	results chan pipelineResult
+	nextSeq uint64
+
+	handlers   sync.WaitGroup
+	writerDone chan struct{}
+
+	// err is the first error occured in handlers or while writing responses
+	errMu sync.Mutex
+	err   error
+}
+
+type pipelineResult struct {
+	seq  uint64
+	resp frame.Frame
+	ok   bool
+	msg  *pipelineMessage
+}
+
+// pipelineMessage holds the pooled buffers of the message. They are released
+// once both the response is written and the After callbacks are called
+type pipelineMessage struct {
+	ctx     *ServerContext
+	payload []byte
+	refs    atomic.Int32
+}
+
+func (m *pipelineMessage) release() {
+	if m.refs.Add(-1) == 0 {
+		bufpool.PutBuffer(m.ctx.resp)
+		bufpool.Put(m.payload)
+	}
+}
+
+func newPipeline(connCtx *ServerContext) *pipeline {
+	cfg := connCtx.server.pipeline
+	p := &pipeline{
+		connCtx:    connCtx,
+		order:      cfg.Order,
+		slots:      make(chan struct{}, cfg.MaxInFlight),
+		results:    make(chan pipelineResult, cfg.MaxInFlight),
+		writerDone: make(chan struct{}),
+	}
+	go p.writeLoop()
+	return p
+}
+
+// dispatch reads the incoming frame and starts handling it in the
+// background. Blocks while there are no free slots or the worker pool is full
+func (p *pipeline) dispatch(connCtx *ServerContext) error {
+	p.slots <- struct{}{}
+	f, err := connCtx.conn.ReadFrame()
+	if err != nil {
+		<-p.slots
+		// the error frame is read along with the error
+		connCtx.conn.ReleaseFrame(f)
+		return err
+	}
+
+	msg := &pipelineMessage{ctx: new(ServerContext), payload: f.Payload}
+	msg.refs.Store(2)
+	msgCtx := msg.ctx
+	cancel := connCtx.withFrame(msgCtx, f)
+	seq := p.nextSeq
+	p.nextSeq++
+	p.handlers.Add(1)
+	err = connCtx.executeAsync(func() {
+		defer p.handlers.Done()
+		defer msg.release()
+		defer cancel()
+		resp, ok, msgErr := msgCtx.serveFrame()
+		if msgErr != nil {
+			var err error
+			if resp, ok, err = msgCtx.frameErr(msgErr); err != nil {
+				p.fail(err)
+			}
+		}
+		p.results <- pipelineResult{seq: seq, resp: resp, ok: ok, msg: msg}
+		msgCtx.runAfterHooks(msgErr)
+	})
+	if err != nil {
+		cancel()
+		p.handlers.Done()
+		<-p.slots
+		bufpool.PutBuffer(msgCtx.resp)
+		connCtx.conn.ReleaseFrame(f)
+	}
+	return err
+}
+
+func (p *pipeline) writeLoop() {
+	defer close(p.writerDone)
+
+	// responses that are ready but wait for the previous ones
+	pending := map[uint64]pipelineResult{}
+	var next uint64
+	for res := range p.results {
+		if p.order == ResponseOrderCorrelated {
+			p.write(res)
+			continue
+		}
+		pending[res.seq] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			p.write(res)
+		}
+	}
+}
+
+// write sends the response to client and frees the slot
+func (p *pipeline) write(res pipelineResult) {
+	defer func() { <-p.slots }()
+	defer res.msg.release()
+	if !res.ok || p.failed() {
+		return
+	}
+	if err := p.connCtx.conn.WriteFrame(res.resp); err != nil {
+		p.fail(err)
+		return
+	}
+	// the responses ready at once are sent together
+	if len(p.results) == 0 {
+		if err := p.connCtx.conn.Flush(); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// fail stops the pipeline because of the error and closes the connection
+func (p *pipeline) fail(err error) {
+	p.errMu.Lock()
+	first := p.err == nil
+	if first {
+		p.err = err
+	}
+	p.errMu.Unlock()
+	if first {
+		p.connCtx.conn.Close()
+	}
+}
+
+func (p *pipeline) failed() bool {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err != nil
+}
+
+// shutdown waits for the frames in flight to be handled and responded.
+// Must be called once no more frames are dispatched. Returns the
+// error that stopped the pipeline, if there was one
+func (p *pipeline) shutdown() error {
+	p.handlers.Wait()
+	close(p.results)
+	<-p.writerDone
+	return p.err
+}
@@ -0,0 +1,280 @@
+//go:build linux
+
+package easytcp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/common"
+	"github.com/Ghytro/easytcp/internal/sched"
+)
+
+const reactorSupported = true
+
+// reactor parks the connections waiting for the data in the epoll. Every
+// connection is armed once, so the readiness is reported to the single
+// goroutine serving the connection until it's parked again
+type reactor struct {
+	server  *Server
+	workers *sched.Scheduler
+	epfd    int
+
+	// wake interrupts the epoll loop once the reactor is stopped
+	wake [2]int
+	done chan struct{}
+
+	mu    sync.Mutex
+	conns map[int32]*reactorConn
+}
+
+// reactorConn is the connection registered in the reactor. It's served
+// by the short-lived goroutine once the data arrives or idle timeout expires
+type reactorConn struct {
+	r         *reactor
+	serverCtx context.Context
+	sCtx      *ServerContext
+	handle    func(*ServerContext) error
+	fd        int32
+
+	// busy is set while the connection is served, so it's never
+	// served by two goroutines at once
+	busy atomic.Bool
+	idle *time.Timer
+
+	// closed is called once the connection is unregistered
+	closed    func()
+	closeOnce sync.Once
+}
+
+func newReactor(s *Server, workers *sched.Scheduler) (*reactor, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	r := &reactor{
+		server:  s,
+		workers: workers,
+		epfd:    epfd,
+		done:    make(chan struct{}),
+		conns:   make(map[int32]*reactorConn),
+	}
+	if err := syscall.Pipe2(r.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(r.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, r.wake[0], &event); err != nil {
+		r.closeFds()
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *reactor) run() {
+	defer close(r.done)
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(r.epfd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			log.Print(common.WrapErr(err))
+			return
+		}
+		for _, event := range events[:n] {
+			if event.Fd == int32(r.wake[0]) {
+				return
+			}
+			r.mu.Lock()
+			rc := r.conns[event.Fd]
+			r.mu.Unlock()
+			if rc != nil {
+				rc.wakeUp()
+			}
+		}
+	}
+}
+
+// stop stops the epoll loop. Must be called once all the
+// connections are closed
+func (r *reactor) stop() {
+	syscall.Write(r.wake[1], []byte{0})
+	<-r.done
+	r.closeFds()
+}
+
+func (r *reactor) closeFds() {
+	syscall.Close(r.wake[0])
+	syscall.Close(r.wake[1])
+	syscall.Close(r.epfd)
+}
+
+// add runs the OnConnect handler and parks the connection.
+// closed is called once the connection is closed
+func (r *reactor) add(serverCtx context.Context, conn net.Conn, closed func()) {
+	s := r.server
+	sCtx := s.newConnContext(serverCtx, conn)
+	if err := s.connect(sCtx, r.workers); err != nil {
+		s.disconnect(serverCtx, sCtx, DisconnectError, err)
+		closed()
+		return
+	}
+
+	rc := &reactorConn{
+		r:         r,
+		serverCtx: serverCtx,
+		sCtx:      sCtx,
+		handle:    s.messageHandler(),
+		closed:    closed,
+	}
+	// the connection is armed once the setup is done
+	rc.busy.Store(true)
+	if err := rc.register(conn); err != nil {
+		rc.close(DisconnectError, err)
+		return
+	}
+	if s.idleTimeout > 0 {
+		rc.idle = time.AfterFunc(s.idleTimeout, rc.onIdle)
+	}
+	// the connection closed while parked is unregistered as well
+	context.AfterFunc(sCtx.connCtx, rc.onClosed)
+	rc.park()
+}
+
+func (rc *reactorConn) register(conn net.Conn) error {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("connection doesn't expose the file descriptor")
+	}
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fd int
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+	rc.fd = int32(fd)
+
+	r := rc.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the descriptor of the closed connection may be reused
+	// before the connection is unregistered
+	r.conns[rc.fd] = rc
+	event := syscall.EpollEvent{Events: reactorEvents, Fd: rc.fd}
+	return syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+}
+
+const reactorEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// park waits for the next data in the epoll. The read buffer
+// is released while the connection is parked
+func (rc *reactorConn) park() {
+	if !rc.sCtx.conn.ReleaseBuffer() {
+		// the data is already there
+		go rc.serve()
+		return
+	}
+	rc.busy.Store(false)
+
+	r := rc.r
+	r.mu.Lock()
+	// the descriptor is taken by another connection once this one is closed
+	err := net.ErrClosed
+	if r.conns[rc.fd] == rc {
+		event := syscall.EpollEvent{Events: reactorEvents, Fd: rc.fd}
+		err = syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_MOD, int(rc.fd), &event)
+	}
+	r.mu.Unlock()
+	if err == nil {
+		return
+	}
+	if rc.busy.CompareAndSwap(false, true) {
+		if rc.sCtx.connCtx.Err() != nil {
+			err = nil
+		}
+		rc.close(disconnectReason(err), err)
+	}
+}
+
+// wakeUp serves the connection once the data arrives
+func (rc *reactorConn) wakeUp() {
+	if rc.busy.CompareAndSwap(false, true) {
+		go rc.serve()
+	}
+}
+
+// serve handles all the messages that arrived and parks the connection
+func (rc *reactorConn) serve() {
+	if rc.idle != nil {
+		rc.idle.Stop()
+	}
+	s := rc.r.server
+	for {
+		if reason, ok, err := s.serveNext(rc.sCtx, rc.handle); !ok {
+			rc.close(reason, err)
+			return
+		}
+		if rc.sCtx.conn.Buffered() == 0 {
+			break
+		}
+	}
+	if rc.idle != nil {
+		rc.idle.Reset(s.idleTimeout)
+	}
+	rc.park()
+}
+
+// onIdle calls the OnIdle handler if nothing arrived during the idle timeout
+func (rc *reactorConn) onIdle() {
+	if !rc.busy.CompareAndSwap(false, true) {
+		// the connection is served, the timer is reset after it
+		return
+	}
+	if reason, ok, err := rc.r.server.idle(rc.sCtx); !ok {
+		rc.close(reason, err)
+		return
+	}
+	rc.idle.Reset(rc.r.server.idleTimeout)
+	// the data may arrive while OnIdle is running, then the connection
+	// wasn't woken up, so it's armed once again
+	rc.park()
+}
+
+// onClosed unregisters the connection closed while parked. The connection
+// closed while served is unregistered by the goroutine serving it
+func (rc *reactorConn) onClosed() {
+	if rc.busy.CompareAndSwap(false, true) {
+		rc.close(DisconnectError, nil)
+	}
+}
+
+// close unregisters and closes the connection. Must be called
+// by the goroutine that set the busy flag
+func (rc *reactorConn) close(reason DisconnectReason, err error) {
+	rc.closeOnce.Do(func() {
+		if rc.idle != nil {
+			rc.idle.Stop()
+		}
+		r := rc.r
+		r.mu.Lock()
+		if r.conns[rc.fd] == rc {
+			delete(r.conns, rc.fd)
+			syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_DEL, int(rc.fd), nil)
+		}
+		r.mu.Unlock()
+
+		r.server.disconnect(rc.serverCtx, rc.sCtx, reason, err)
+		rc.closed()
+	})
+}
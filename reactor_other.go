@@ -0,0 +1,25 @@
+//go:build !linux
+
+package easytcp
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/Ghytro/easytcp/internal/sched"
+)
+
+const reactorSupported = false
+
+// reactor is only implemented on linux, the
+// server refuses to listen in reactor mode
+type reactor struct{}
+
+func newReactor(*Server, *sched.Scheduler) (*reactor, error) {
+	return nil, errors.New("reactor mode is not supported on this platform")
+}
+
+func (r *reactor) add(context.Context, net.Conn, func()) {}
+
+func (r *reactor) stop() {}
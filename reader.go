@@ -0,0 +1,116 @@
+package easytcp
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/Ghytro/easytcp/internal/connection"
+)
+
+// ErrTooLong is returned from ReadUntil when the delimiter
+// is not found within the max frame size
+var ErrTooLong = connection.ErrTooLong
+
+// bufferedReader is the source of the incoming data of ServerContext:
+// the connection itself, or the payload of the current frame in framed mode
+type bufferedReader interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+	ReadFull(b []byte) (int, error)
+	ReadUntil(delim byte) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+func (ctx *ServerContext) reader() bufferedReader {
+	if ctx.frame != nil {
+		return &ctx.in
+	}
+	return ctx.conn
+}
+
+// Peek returns the next n bytes without consuming them. The bytes stay
+// valid until the next read. In framed mode the bytes are peeked from
+// the payload of the current frame and stay valid until it's handled
+func (ctx *ServerContext) Peek(n int) ([]byte, error) {
+	return ctx.reader().Peek(n)
+}
+
+// ReadFull reads exactly len(b) bytes. If less bytes are available
+// in the payload of the current frame, io.ErrUnexpectedEOF is returned
+func (ctx *ServerContext) ReadFull(b []byte) (int, error) {
+	return ctx.reader().ReadFull(b)
+}
+
+func (ctx *ServerContext) ReadByte() (byte, error) {
+	return ctx.reader().ReadByte()
+}
+
+// ReadUntil reads until the first occurence of delim and returns the data
+// including the delimiter. If the delimiter is not in the payload of the
+// current frame, the rest of the payload is returned along with io.EOF
+func (ctx *ServerContext) ReadUntil(delim byte) ([]byte, error) {
+	return ctx.reader().ReadUntil(delim)
+}
+
+// Discard skips the next n bytes
+func (ctx *ServerContext) Discard(n int) (int, error) {
+	return ctx.reader().Discard(n)
+}
+
+// payloadReader reads the payload of the frame with
+// the same semantics as the connection reader
+type payloadReader struct {
+	b   []byte
+	off int
+}
+
+func (r *payloadReader) Read(b []byte) (int, error) {
+	if r.off == len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(b, r.b[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func (r *payloadReader) ReadByte() (byte, error) {
+	if r.off == len(r.b) {
+		return 0, io.EOF
+	}
+	r.off++
+	return r.b[r.off-1], nil
+}
+
+func (r *payloadReader) Peek(n int) ([]byte, error) {
+	rest := r.b[r.off:]
+	if n > len(rest) {
+		return rest, io.EOF
+	}
+	return rest[:n], nil
+}
+
+func (r *payloadReader) ReadFull(b []byte) (int, error) {
+	return io.ReadFull(r, b)
+}
+
+func (r *payloadReader) ReadUntil(delim byte) ([]byte, error) {
+	rest := r.b[r.off:]
+	i := bytes.IndexByte(rest, delim)
+	if i < 0 {
+		r.off = len(r.b)
+		return append([]byte(nil), rest...), io.EOF
+	}
+	r.off += i + 1
+	return append([]byte(nil), rest[:i+1]...), nil
+}
+
+func (r *payloadReader) Discard(n int) (int, error) {
+	rest := len(r.b) - r.off
+	if n > rest {
+		r.off = len(r.b)
+		return rest, io.EOF
+	}
+	r.off += n
+	return n, nil
+}
@@ -0,0 +1,45 @@
+package easytcp
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Ghytro/easytcp/internal/common"
+	"github.com/Ghytro/easytcp/internal/connection"
+)
+
+// SendFile sends n bytes of the file starting at offset to the client. On
+// linux tcp connections the file is sent with sendfile(2) without copying it
+// through user space. Otherwise, for example if the connection is wrapped with
+// TLS, the file is copied. In framed mode the file is appended to the response
+// frame. The offset of the file is not changed. If the file is shorter than
+// offset+n, io.ErrUnexpectedEOF is returned
+func (ctx *ServerContext) SendFile(f *os.File, offset, n int64) (int64, error) {
+	if ctx.frame != nil {
+		written, err := ctx.resp.ReadFrom(io.NewSectionReader(f, offset, n))
+		if err == nil && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return written, err
+	}
+	return ctx.conn.SendFile(f, offset, n)
+}
+
+// Proxy pipes the client and the peer connection into each other until
+// either of them is closed, then both connections are closed and the client
+// is disconnected with DisconnectClientClosed. On linux tcp
+// connections the data is spliced in the kernel without copying it through
+// user space. The peer must be the connection of the Client. Can't be used
+// in framed mode
+func (ctx *ServerContext) Proxy(peer IConnection) error {
+	if ctx.server.framed {
+		return common.WrapErr(errors.New("proxy can't be used in framed mode"))
+	}
+	peerConn, ok := peer.(*connection.Connection)
+	if !ok {
+		return common.WrapErr(errors.New("proxy peer is not the connection of the client"))
+	}
+	ctx.proxied = true
+	return connection.Proxy(ctx.conn, peerConn)
+}
@@ -1,23 +1,105 @@
 package easytcp
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Ghytro/easytcp/internal/bufpool"
 	"github.com/Ghytro/easytcp/internal/common"
 	"github.com/Ghytro/easytcp/internal/connection"
+	"github.com/Ghytro/easytcp/internal/frame"
+	"github.com/Ghytro/easytcp/internal/sched"
 )
 
 type ServerHandler func(ctx *ServerContext) error
 
-type ErrHandler func(ctx *ServerContext, err error) error
+// ErrHandler is called on every error occured while serving the connection.
+// For the errors returned from the message handlers it decides what to do
+// next, all the other errors close the connection regardless of the action.
+//
+// Breaking change: the handler used to return error, which was ignored and the
+// connection was always closed. Such handlers are wrapped with LegacyErrHandler
+type ErrHandler func(ctx *ServerContext, err error) ErrAction
+
+// LegacyErrHandler adapts the error handler of the former signature. The
+// connection is closed on every error, the same as before ErrAction, and
+// the error returned from fn is ignored
+func LegacyErrHandler(fn func(ctx *ServerContext, err error) error) ErrHandler {
+	return func(ctx *ServerContext, err error) ErrAction {
+		fn(ctx, err)
+		return ErrActionClose
+	}
+}
 
 type ServerConfig struct {
 	ReadTimeout, WriteTimeout time.Duration
+
+	// KeepOpenOnTimeout makes the expired read and write timeouts of
+	// ServerContext return ErrTimeout and leave the connection usable,
+	// so the handlers may wait for the optional data. By default the
+	// connection is closed on timeout
+	KeepOpenOnTimeout bool
+
+	// IdleTimeout is a period without any incoming packets after which
+	// the OnIdle handler is called. Zero means that idle connections are
+	// never tracked
+	IdleTimeout time.Duration
+
+	// Framed switches the server to the easytcp framed protocol. Every incoming
+	// message is a frame, handlers read only the payload of the current frame and
+	// everything sent during the handler chain is replied in a single frame with
+	// the id of the request. If nothing is sent, no response frame is written
+	Framed bool
+
+	// MaxFrameSize limits the payload size of the incoming frames
+	// and the data read with ServerContext.ReadUntil
+	MaxFrameSize int
+
+	// ReadBufferSize is the size of the read buffer of every
+	// connection. ServerContext.Peek can't look further than that
+	ReadBufferSize int
+
+	// WriteBatch gathers the writes made during the handler chain, so they
+	// are sent with a single vectored write once the chain completes, or once
+	// the size or latency threshold is reached. Disabled by default
+	WriteBatch WriteBatchConfig
+
+	// Pipeline configures the concurrent handling of the frames pipelined
+	// by the client on a single connection. Requires Framed
+	Pipeline PipelineConfig
+
+	// HandlerTimeout bounds the context of every single message, so the
+	// calls made by handlers are cancelled once it expires. Zero means that
+	// the message context is only cancelled with the connection context
+	HandlerTimeout time.Duration
+
+	// PropagateFrameTimeout makes the timeout sent by the client in the
+	// frame header bound the message context as well. The smaller one of
+	// HandlerTimeout and the frame timeout is used
+	PropagateFrameTimeout bool
+
+	// WorkerPool limits the amount of handlers running at once across
+	// all the connections. Disabled by default
+	WorkerPool WorkerPoolConfig
+
+	// Outbound configures the queue of the messages sent with
+	// ServerContext.SendAsync. The queue holds 64 messages by default
+	Outbound OutboundConfig
+
+	// Reactor parks the connections waiting for the data in the epoll
+	// instead of blocking a goroutine on every one of them. The parked
+	// connections hold neither a goroutine nor a read buffer, the handlers
+	// are run once the data arrives. Linux only, doesn't support pipelining
+	Reactor bool
+
+	// Socket tunes the socket of every accepted connection
+	Socket SocketOptions
 }
 
 func (c *ServerConfig) setDefault() {
@@ -27,23 +109,44 @@ func (c *ServerConfig) setDefault() {
 	if c.WriteTimeout == 0 {
 		c.WriteTimeout = DefaultServerConfig.WriteTimeout
 	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultServerConfig.IdleTimeout
+	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = DefaultServerConfig.MaxFrameSize
+	}
+	if c.Outbound.QueueSize <= 0 {
+		c.Outbound.QueueSize = DefaultServerConfig.Outbound.QueueSize
+	}
 }
 
 var DefaultServerConfig = ServerConfig{
 	ReadTimeout:  time.Second * 10,
 	WriteTimeout: time.Second * 10,
+	MaxFrameSize: frame.DefaultMaxSize,
+	Outbound:     OutboundConfig{QueueSize: 64},
 }
 
-func DefaultErrorHandler(ctx *ServerContext, err error) error {
+// DefaultErrorHandler replies with the errors that have wire representation,
+// such as *Error, and closes the connection on all the other errors
+func DefaultErrorHandler(ctx *ServerContext, err error) ErrAction {
+	if _, ok := wireError(err); ok {
+		return ErrActionReply
+	}
 	log.Print(err)
-	return nil
+	return ErrActionClose
 }
 
 type Server struct {
 	// handlers proceed the incoming tcp stream and put additional data in context
-	handlers   []ServerHandler
-	onConnect  ServerHandler
-	errHandler ErrHandler
+	handlers     []ServerHandler
+	onConnect    ServerHandler
+	onDisconnect DisconnectHandler
+	onIdle       ServerHandler
+	errHandler   ErrHandler
+
+	// optional protocol state machine dispatched after the handlers
+	stateMachine *StateMachine
 
 	// Timeout for an unmarshaller to proceed the incoming byte stream. This timeout
 	// is only for network, so don't confuse it with your program's additional runtime delay
@@ -52,6 +155,33 @@ type Server struct {
 	// Timeout to write a response to client. This timeout is only for network, so don't confuse
 	// it with your program's additional runtime delay
 	responseTimeout time.Duration
+
+	// Period without incoming packets after which the connection is considered idle
+	idleTimeout time.Duration
+
+	framed       bool
+	maxFrameSize int
+	readBufSize  int
+	writeBatch   WriteBatchConfig
+	pipeline     PipelineConfig
+
+	handlerTimeout time.Duration
+
+	// if the timeouts sent by the client in the frame header bound the message context
+	frameTimeouts bool
+
+	workerPool WorkerPoolConfig
+
+	// if the connections waiting for the data are parked in the epoll
+	reactor bool
+
+	outbound        OutboundConfig
+	outboundDepth   atomic.Int64
+	outboundDropped atomic.Uint64
+
+	socket SocketOptions
+
+	keepOpenOnTimeout bool
 }
 
 func NewServer(config ...ServerConfig) *Server {
@@ -63,6 +193,19 @@ func NewServer(config ...ServerConfig) *Server {
 	return &Server{
 		unmarshallerTimeout: cfg.ReadTimeout,
 		responseTimeout:     cfg.WriteTimeout,
+		idleTimeout:         cfg.IdleTimeout,
+		framed:              cfg.Framed,
+		maxFrameSize:        cfg.MaxFrameSize,
+		readBufSize:         cfg.ReadBufferSize,
+		writeBatch:          cfg.WriteBatch,
+		pipeline:            cfg.Pipeline,
+		handlerTimeout:      cfg.HandlerTimeout,
+		frameTimeouts:       cfg.PropagateFrameTimeout,
+		workerPool:          cfg.WorkerPool,
+		reactor:             cfg.Reactor,
+		outbound:            cfg.Outbound,
+		socket:              cfg.Socket,
+		keepOpenOnTimeout:   cfg.KeepOpenOnTimeout,
 	}
 }
 
@@ -76,13 +219,33 @@ func (s *Server) OnConnect(fn ServerHandler) {
 	s.onConnect = fn
 }
 
+// OnDisconnect is called when the client connection is closed, no matter
+// who closed it and why. Use it to release the resources bound to connection
+func (s *Server) OnDisconnect(fn DisconnectHandler) {
+	s.onDisconnect = fn
+}
+
+// OnIdle is called every time the client doesn't send anything during
+// the idle timeout set in ServerConfig. If the handler returns an error,
+// the connection is closed. If no handler is set, the idle connection is
+// closed as well
+func (s *Server) OnIdle(fn ServerHandler) {
+	s.onIdle = fn
+}
+
+// StateMachine sets the protocol state machine every connection goes through.
+// The state machine is dispatched after all the registered handlers
+func (s *Server) StateMachine(m *StateMachine) {
+	s.stateMachine = m
+}
+
 func (s *Server) ErrorHandler(fn ErrHandler) {
 	s.errHandler = fn
 }
 
-func (s *Server) handleErr(ctx *ServerContext, err error) error {
+func (s *Server) handleErr(ctx *ServerContext, err error) ErrAction {
 	if err == nil {
-		return nil
+		return ErrActionContinue
 	}
 	if s.errHandler != nil {
 		return s.errHandler(ctx, err)
@@ -93,7 +256,9 @@ func (s *Server) handleErr(ctx *ServerContext, err error) error {
 // Listen starts listening tcp connection via net.Listen. You can pass the
 // additional context to stop listening when it's done. The method is blocking
 // until the error occurs or context will be done and returns an error that explains
-// why the connection was closed: was that a context, or some kind of internal error
+// why the connection was closed: was that a context, or some kind of internal error.
+// When the context is done, all the client connections are closed and Listen waits
+// for their handlers to return
 func (s *Server) Listen(ctx context.Context, addr string) error {
 	if err := s.validateBeforeListen(); err != nil {
 		return common.WrapErr(err)
@@ -103,9 +268,32 @@ func (s *Server) Listen(ctx context.Context, addr string) error {
 	if err != nil {
 		return err
 	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	workers := s.workerPool.newScheduler()
+	if workers != nil {
+		defer workers.Close()
+	}
+
+	var r *reactor
+	if s.reactor {
+		if r, err = newReactor(s, workers); err != nil {
+			return common.WrapErr(err)
+		}
+		defer r.stop()
+	}
+
+	var connWg sync.WaitGroup
+	defer connWg.Wait()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if conn != nil {
 				err = common.NestedCloseConnErr(err, conn.Close())
 			}
@@ -123,14 +311,49 @@ func (s *Server) Listen(ctx context.Context, addr string) error {
 			}
 			continue
 		}
+		if err := connection.SetSocketOptions(conn, s.socket); err != nil {
+			log.Print(common.WrapErr(common.NestedCloseConnErr(err, conn.Close())))
+			continue
+		}
+
+		connWg.Add(1)
+		if r != nil {
+			go r.add(ctx, conn, connWg.Done)
+			continue
+		}
+		go func() {
+			defer connWg.Done()
+			s.connHandler(ctx, conn, workers)
+		}()
+	}
+}
 
-		go s.connHandler(conn)
+func (s *Server) connHandler(serverCtx context.Context, conn net.Conn, workers *sched.Scheduler) {
+	sCtx := s.newConnContext(serverCtx, conn)
+	reason, err := DisconnectError, s.connect(sCtx, workers)
+	defer func() {
+		s.disconnect(serverCtx, sCtx, reason, err)
+	}()
+	if err != nil {
+		return
+	}
+
+	switch {
+	case s.framed && s.pipeline.MaxInFlight > 1:
+		p := newPipeline(sCtx)
+		reason, err = s.serve(sCtx, p.dispatch)
+		if pipelineErr := p.shutdown(); pipelineErr != nil {
+			reason, err = disconnectReason(pipelineErr), pipelineErr
+		}
+	default:
+		reason, err = s.serve(sCtx, s.messageHandler())
 	}
 }
 
-func (s *Server) connHandler(conn net.Conn) {
-	// parent context notifies about closed connection
-	parentCtx, notifyClosed := context.WithCancel(context.Background())
+// newConnContext wraps the accepted connection. The context of the
+// connection is cancelled once the connection is closed
+func (s *Server) newConnContext(serverCtx context.Context, conn net.Conn) *ServerContext {
+	parentCtx, notifyClosed := context.WithCancel(serverCtx)
 	tcpConn := connection.NewConnection(
 		parentCtx,
 		conn,
@@ -138,61 +361,149 @@ func (s *Server) connHandler(conn net.Conn) {
 		connection.ConnectionConfig{
 			ReadTimeout:  s.unmarshallerTimeout,
 			WriteTimeout: s.responseTimeout,
+			MaxFrameSize: s.maxFrameSize,
+
+			ReadBufferSize:    s.readBufSize,
+			WriteBatch:        s.writeBatch,
+			KeepOpenOnTimeout: s.keepOpenOnTimeout,
+			OnClose:           notifyClosed,
 		},
 	)
 
-	go func() {
-		<-tcpConn.CloseNotifier()
-		notifyClosed()
-	}()
-
-	defer tcpConn.Close()
-
 	sCtx := &ServerContext{
 		ctx:        parentCtx,
+		connCtx:    parentCtx,
 		server:     s,
-		vals:       map[string]interface{}{},
+		vals:       common.NewKVStore(),
+		msgVals:    common.NewKVStore(),
 		handlerIdx: 0,
 		conn:       tcpConn,
-		resp:       new(bytes.Buffer),
+		resp:       bufpool.GetBuffer(),
+	}
+	if s.stateMachine != nil {
+		sCtx.state = newConnState(s.stateMachine, func() { tcpConn.Close() })
 	}
+	sCtx.outbound = newOutbound(sCtx)
+	return sCtx
+}
+
+// connect runs the OnConnect handler and joins the connection to the
+// worker pool. The error is already handled with the error handler
+func (s *Server) connect(sCtx *ServerContext, workers *sched.Scheduler) error {
 	if s.onConnect != nil {
 		if err := s.onConnect(sCtx); err != nil {
 			s.handleErr(sCtx, err)
-			return
+			return &handledError{err: err}
 		}
 	}
+	sCtx.joinWorkerPool(workers)
+	return nil
+}
+
+// messageHandler returns the handler of a single incoming message
+func (s *Server) messageHandler() func(*ServerContext) error {
+	if s.framed {
+		return (*ServerContext).handleFrame
+	}
+	return (*ServerContext).executeMessage
+}
+
+// disconnect closes the connection, handles the error it was closed
+// with, if there is one, and calls the OnDisconnect handler
+func (s *Server) disconnect(serverCtx context.Context, sCtx *ServerContext, reason DisconnectReason, err error) {
+	if expiredErr := sCtx.stateExpiredErr(); expiredErr != nil {
+		reason, err = DisconnectTimeout, expiredErr
+	}
+	if slowErr := sCtx.outbound.slowConsumerErr(); slowErr != nil {
+		reason, err = DisconnectError, slowErr
+	}
+	if sCtx.proxied && errors.Is(err, net.ErrClosed) {
+		reason, err = DisconnectClientClosed, nil
+	}
+	if serverCtx.Err() != nil {
+		reason = DisconnectServerShutdown
+	}
+	var handled *handledError
+	if err != nil && reason != DisconnectClientClosed && reason != DisconnectServerShutdown && !errors.As(err, &handled) {
+		s.handleErr(sCtx, err)
+	}
+	if reason == DisconnectClientClosed && errors.Is(err, io.EOF) {
+		// the client may have closed only its writing side,
+		// so it still reads the messages queued before
+		sCtx.outbound.finish()
+		sCtx.conn.Flush()
+	}
+	sCtx.conn.Close()
+	sCtx.outbound.shutdown()
+	if sCtx.state != nil {
+		sCtx.state.stop()
+	}
+	if s.onDisconnect != nil {
+		s.onDisconnect(sCtx, reason)
+	}
+
+	// the buffers are reused by the next connections
+	sCtx.conn.ReleaseBuffer()
+	bufpool.PutBuffer(sCtx.resp)
+	if sCtx.serial != nil {
+		bufpool.PutBuffer(sCtx.serial.resp)
+	}
+}
+
+// serve waits for the incoming packets and handles them until the connection
+// should be closed. Returns the reason of closing and the error to be handled
+// with the error handler, if there is one
+func (s *Server) serve(sCtx *ServerContext, handle func(*ServerContext) error) (DisconnectReason, error) {
 	for {
-		// execute all the attached handlers
-		sCtx.handlerIdx = 0
-		if err := sCtx.Next(); err != nil {
-			s.handleErr(sCtx, err)
-			return
+		if reason, ok, err := s.serveNext(sCtx, handle); !ok {
+			return reason, err
 		}
+	}
+}
 
-		// if the user has written the response, send in to socket
-		if sCtx.resp.Len() != 0 {
-			n, err := sCtx.SendBuf()
-			if err != nil {
-				err := common.WrapErr(common.NestedCloseConnErr(err, tcpConn.Close()))
-				s.handleErr(sCtx, err)
-				return
-			}
-			if n != sCtx.resp.Len() {
-				err := errors.New("not all the bytes were written to response, connection closed")
-				err = common.WrapErr(common.NestedCloseConnErr(err, tcpConn.Close()))
-				s.handleErr(sCtx, err)
-				return
-			}
+// serveNext waits for the next packet and handles it, or calls the OnIdle
+// handler if nothing arrives in time. Returns false if the connection should be closed
+func (s *Server) serveNext(sCtx *ServerContext, handle func(*ServerContext) error) (DisconnectReason, bool, error) {
+	if err := sCtx.conn.WaitForPacketTimeout(s.idleTimeout); err != nil {
+		if !errors.Is(err, connection.ErrWaitTimeout) {
+			return disconnectReason(err), false, err
 		}
+		return s.idle(sCtx)
+	}
+	if err := handle(sCtx); err != nil {
+		return disconnectReason(err), false, err
+	}
+	return 0, true, nil
+}
+
+// idle calls the OnIdle handler. Returns false if the connection should be closed
+func (s *Server) idle(sCtx *ServerContext) (DisconnectReason, bool, error) {
+	if s.onIdle == nil {
+		return DisconnectTimeout, false, nil
+	}
+	if err := s.onIdle(sCtx); err != nil {
+		return DisconnectTimeout, false, err
 	}
+	return 0, true, nil
 }
 
 // validateBeforeListen check if all the fields are valid
 // before launching the server
 func (s *Server) validateBeforeListen() error {
-	if len(s.handlers) == 0 {
+	if len(s.handlers) == 0 && s.stateMachine == nil {
 		return errors.New("the handler cannot be nil, all the packets will be ignored")
 	}
+	if s.pipeline.MaxInFlight > 1 && !s.framed {
+		return errors.New("pipelining requires the framed protocol to be enabled")
+	}
+	if s.reactor && !reactorSupported {
+		return errors.New("reactor mode is not supported on this platform")
+	}
+	if s.reactor && s.pipeline.MaxInFlight > 1 {
+		return errors.New("reactor mode doesn't support pipelining")
+	}
+	if s.stateMachine != nil {
+		return s.stateMachine.validate()
+	}
 	return nil
 }
@@ -0,0 +1,143 @@
+package easytcp
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ShardingConfig configures routing of the keyed sessions across the endpoints
+// with the consistent hash ring, so the endpoint of the key changes only if
+// the endpoint itself is added or removed
+type ShardingConfig struct {
+	// VirtualNodes is the amount of points of the endpoint on the ring per
+	// unit of its weight. The more of them, the more even the keys are
+	// spread across the endpoints. Defaults to 160
+	VirtualNodes int
+
+	// LoadFactor bounds the outstanding sessions of every endpoint to
+	// LoadFactor times its share of all the outstanding sessions. The keyed
+	// session going to the endpoint over the bound goes to the next one on
+	// the ring, so the hot keys don't overload the single endpoint. Zero
+	// disables the bound, the values below 1 are raised to 1
+	LoadFactor float64
+}
+
+func (c *ShardingConfig) setDefault() {
+	if c.VirtualNodes <= 0 {
+		c.VirtualNodes = 160
+	}
+	if c.LoadFactor > 0 && c.LoadFactor < 1 {
+		c.LoadFactor = 1
+	}
+}
+
+// WithKeySession runs fn with the connection of the endpoint the key
+// is mapped to. The sessions of the same key go to the same endpoint
+// while it's not removed, unless the load of the endpoint is bounded
+func (c *Client) WithKeySession(key string, fn func(conn IConnection) error) error {
+	return c.WithKeySessionContext(context.Background(), key, fn)
+}
+
+// WithKeySessionContext is the same as WithKeySession, but waits for
+// the connection until ctx is done, the same as WithSessionContext
+func (c *Client) WithKeySessionContext(ctx context.Context, key string, fn func(conn IConnection) error) error {
+	return c.session(ctx, func() (*ClientEndpoint, error) {
+		return c.pickKey(key)
+	}, fn)
+}
+
+// pickKey chooses the endpoint of the key on the ring
+func (c *Client) pickKey(key string) (*ClientEndpoint, error) {
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	ring := c.ring.Load()
+	if len(ring.points) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	return ring.lookup(key, c.sharding.LoadFactor), nil
+}
+
+// rebuildRing places the current endpoints on the ring.
+// Must be called with endpointsMu locked
+func (c *Client) rebuildRing() {
+	c.ring.Store(newHashRing(*c.endpoints.Load(), c.sharding.VirtualNodes))
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint *ClientEndpoint
+}
+
+// hashRing is immutable, so it's replaced as a whole once the endpoints change
+type hashRing struct {
+	points      []ringPoint
+	endpoints   []*ClientEndpoint
+	totalWeight int
+}
+
+func newHashRing(endpoints []*ClientEndpoint, virtualNodes int) *hashRing {
+	ring := &hashRing{endpoints: endpoints}
+	for _, e := range endpoints {
+		ring.totalWeight += e.Weight()
+		for i := 0; i < virtualNodes*e.Weight(); i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:     hashKey(e.address + "#" + strconv.Itoa(i)),
+				endpoint: e,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// lookup returns the first endpoint clockwise from the key. If the load is
+// bounded, the endpoints over the bound are skipped
+func (ring *hashRing) lookup(key string, loadFactor float64) *ClientEndpoint {
+	h := hashKey(key)
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+	first := ring.points[start%len(ring.points)].endpoint
+	if loadFactor <= 0 || len(ring.endpoints) == 1 {
+		return first
+	}
+
+	total := 0
+	for _, e := range ring.endpoints {
+		total += e.Outstanding()
+	}
+	// the session being started is counted as well
+	share := loadFactor * float64(total+1) / float64(ring.totalWeight)
+	checked := make(map[*ClientEndpoint]struct{}, len(ring.endpoints))
+	for i := 0; i < len(ring.points) && len(checked) < len(ring.endpoints); i++ {
+		e := ring.points[(start+i)%len(ring.points)].endpoint
+		if _, ok := checked[e]; ok {
+			continue
+		}
+		if float64(e.Outstanding()) < math.Ceil(share*float64(e.Weight())) {
+			return e
+		}
+		checked[e] = struct{}{}
+	}
+	return first
+}
+
+// hashKey is the 64-bit FNV-1a hash of the key with the
+// final mixing of splitmix64, so the close keys are spread
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
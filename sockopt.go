@@ -0,0 +1,23 @@
+package easytcp
+
+import "github.com/Ghytro/easytcp/internal/connection"
+
+// SocketOptions tunes the tcp sockets of the connections. The zero
+// fields leave the system defaults
+type SocketOptions = connection.SocketOptions
+
+// TCPInfo is the kernel statistics of the tcp connection
+type TCPInfo = connection.TCPInfo
+
+// SocketOptions reads back the effective options of the client socket.
+// Returns errors.ErrUnsupported on the platforms other than linux
+func (ctx *ServerContext) SocketOptions() (SocketOptions, error) {
+	return ctx.conn.SocketOptions()
+}
+
+// TCPInfo returns the kernel statistics of the client connection, such as
+// the round trip time and the retransmits. Returns errors.ErrUnsupported
+// on the platforms other than linux
+func (ctx *ServerContext) TCPInfo() (TCPInfo, error) {
+	return ctx.conn.TCPInfo()
+}
@@ -0,0 +1,183 @@
+package easytcp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrMessageNotAllowed is returned when the message arrived is not
+	// allowed in the current state of the connection
+	ErrMessageNotAllowed = errors.New("message is not allowed in the current state")
+
+	// ErrStateTimeout is returned when the connection stayed in
+	// the state longer than the state timeout
+	ErrStateTimeout = errors.New("connection stayed in the state for too long")
+
+	// ErrUnknownState is returned on transition to the state
+	// that was not declared in the state machine
+	ErrUnknownState = errors.New("unknown state")
+)
+
+// State is a name of the protocol phase the connection is in,
+// for example "handshake", "auth" or "ready"
+type State string
+
+// MessageClassifier tells the kind of the incoming message, so the state
+// machine can choose the handler allowed in the current state. The classifier
+// is free to read from the connection, for example the message header
+type MessageClassifier func(ctx *ServerContext) (string, error)
+
+// StateConfig declares the behaviour of the connection in the state
+type StateConfig struct {
+	// Handlers are the handlers of the messages allowed in the state
+	// by message kind. All the other messages are rejected with
+	// ErrMessageNotAllowed
+	Handlers map[string]ServerHandler
+
+	// Timeout is the maximum time the connection may stay in the state.
+	// When it expires, the connection is closed with ErrStateTimeout.
+	// Zero means that the connection may stay in the state forever
+	Timeout time.Duration
+}
+
+// StateError explains in which state and with which message
+// the state machine failed
+type StateError struct {
+	State   State
+	Message string
+	Err     error
+}
+
+func (e *StateError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("state %q: %v", e.State, e.Err)
+	}
+	return fmt.Sprintf("state %q, message %q: %v", e.State, e.Message, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// StateMachine declares the phases of the protocol and the messages
+// allowed in each of them. Every connection starts in the initial state
+// and moves between the states with ServerContext.Transition. The state
+// machine is dispatched after all the handlers registered in the server
+// called ServerContext.Next, so they can be used as middlewares
+type StateMachine struct {
+	initial  State
+	classify MessageClassifier
+	states   map[State]StateConfig
+}
+
+func NewStateMachine(initial State, classify MessageClassifier) *StateMachine {
+	return &StateMachine{
+		initial:  initial,
+		classify: classify,
+		states:   map[State]StateConfig{},
+	}
+}
+
+// State declares the state and the messages allowed in it
+func (m *StateMachine) State(name State, cfg StateConfig) {
+	m.states[name] = cfg
+}
+
+func (m *StateMachine) validate() error {
+	if m.classify == nil {
+		return errors.New("state machine message classifier cannot be nil")
+	}
+	if _, ok := m.states[m.initial]; !ok {
+		return fmt.Errorf("state machine initial state %q is not declared", m.initial)
+	}
+	return nil
+}
+
+// connState is a connection-scoped state of the state machine
+type connState struct {
+	machine *StateMachine
+	mu      sync.Mutex
+	current State
+	timer   *time.Timer
+
+	// expired is set when the state timeout fired
+	expired int32
+
+	// onExpire is called when the state timeout fires,
+	// it's expected to close the connection
+	onExpire func()
+}
+
+func newConnState(machine *StateMachine, onExpire func()) *connState {
+	s := &connState{
+		machine:  machine,
+		onExpire: onExpire,
+	}
+	s.enter(machine.initial)
+	return s
+}
+
+func (s *connState) state() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+func (s *connState) transition(to State) error {
+	if _, ok := s.machine.states[to]; !ok {
+		return &StateError{State: to, Err: ErrUnknownState}
+	}
+	s.enter(to)
+	return nil
+}
+
+func (s *connState) enter(to State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.current = to
+	if timeout := s.machine.states[to].Timeout; timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&s.expired, 1)
+			s.onExpire()
+		})
+	}
+}
+
+// stop releases the state timer, must be called once the connection is closed
+func (s *connState) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// expiredErr returns ErrStateTimeout if the state timeout has fired, nil otherwise
+func (s *connState) expiredErr() error {
+	if atomic.LoadInt32(&s.expired) == 0 {
+		return nil
+	}
+	return &StateError{State: s.state(), Err: ErrStateTimeout}
+}
+
+func (s *connState) dispatch(ctx *ServerContext) error {
+	current := s.state()
+	kind, err := s.machine.classify(ctx)
+	if err != nil {
+		return err
+	}
+	handler, ok := s.machine.states[current].Handlers[kind]
+	if !ok {
+		return &StateError{State: current, Message: kind, Err: ErrMessageNotAllowed}
+	}
+	return handler(ctx)
+}
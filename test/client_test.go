@@ -2,8 +2,12 @@ package test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,13 +34,13 @@ func (s *ClientTestSuite) TestClientConnection() {
 	server := prepareDefaultServer(s.T())
 
 	go func() {
-		server.Listen(s.ctx, port)
+		server.Listen(s.ctx, clientPort)
 	}()
 
 	time.Sleep(time.Millisecond * 500)
 
 	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
-		Address:      port,
+		Address:      clientPort,
 		MaxConns:     3,
 		ReadTimeout:  time.Second * 5,
 		WriteTimeout: time.Second * 5,
@@ -78,6 +82,1027 @@ func (s *ClientTestSuite) TestClientConnection() {
 	wg.Wait()
 }
 
+func (s *ClientTestSuite) TestKeepOpenOnTimeout() {
+	const addr = ":9885"
+
+	// every message is a single byte optionally followed by
+	// the second one, the server replies with what it got
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		ReadTimeout:       time.Millisecond * 200,
+		KeepOpenOnTimeout: true,
+	})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		b := make([]byte, 1)
+		if _, err := ctx.Read(b); err != nil {
+			return err
+		}
+		optional := make([]byte, 1)
+		_, err := ctx.Read(optional)
+		if errors.Is(err, easytcp.ErrTimeout) {
+			return ctx.Send(b)
+		}
+		if err != nil {
+			return err
+		}
+		return ctx.Send(append(b, optional...))
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:           addr,
+		MaxConns:          1,
+		ReadTimeout:       time.Millisecond * 100,
+		KeepOpenOnTimeout: true,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		resp := make([]byte, 2)
+
+		// nothing is sent yet, but the connection stays usable
+		_, err := conn.Read(resp)
+		var netErr net.Error
+		s.Require().ErrorAs(err, &netErr)
+		s.True(netErr.Timeout())
+
+		if _, err := conn.Write([]byte("a")); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 300)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return err
+		}
+		s.Equal("a", string(resp[:n]))
+
+		if _, err := conn.Write([]byte("bc")); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		s.Equal("bc", string(resp))
+		return nil
+	})
+	s.NoError(err)
+}
+
+func (s *ClientTestSuite) TestClientClose() {
+	const addr = ":9902"
+
+	// the server never replies, so the sessions block on reading
+	server := easytcp.NewServer()
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		_, err := ctx.ReadByte()
+		return err
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	newClient := func() *easytcp.Client {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  addr,
+			MaxConns: 1,
+		})
+		s.Require().NoError(err)
+		return client
+	}
+
+	s.Run("WaitsForSessions", func() {
+		client := newClient()
+		started, release := make(chan struct{}), make(chan struct{})
+		sessionErr := make(chan error, 1)
+		go func() {
+			sessionErr <- client.WithSession(func(conn easytcp.IConnection) error {
+				close(started)
+				<-release
+				return nil
+			})
+		}()
+		<-started
+
+		// the session waiting for the connection fails once the client is closed
+		waitingErr := make(chan error, 1)
+		go func() {
+			waitingErr <- client.WithSession(func(conn easytcp.IConnection) error { return nil })
+		}()
+
+		closeErr := make(chan error, 1)
+		go func() {
+			closeErr <- client.Close(context.Background())
+		}()
+		time.Sleep(time.Millisecond * 100)
+		s.ErrorIs(client.WithSession(func(conn easytcp.IConnection) error { return nil }), easytcp.ErrClientClosed)
+		select {
+		case <-closeErr:
+			s.FailNow("close doesn't wait for the active session")
+		default:
+		}
+
+		close(release)
+		s.NoError(<-sessionErr)
+		s.NoError(<-closeErr)
+		s.ErrorIs(<-waitingErr, easytcp.ErrClientClosed)
+		s.ErrorIs(client.Close(context.Background()), easytcp.ErrClientClosed)
+	})
+
+	s.Run("Deadline", func() {
+		client := newClient()
+		started := make(chan struct{})
+		sessionErr := make(chan error, 1)
+		go func() {
+			sessionErr <- client.WithSession(func(conn easytcp.IConnection) error {
+				close(started)
+				_, err := conn.Read(make([]byte, 1))
+				return err
+			})
+		}()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		s.ErrorIs(client.Close(ctx), context.DeadlineExceeded)
+		// the connection of the session is closed in use
+		s.Error(<-sessionErr)
+	})
+}
+
+func (s *ClientTestSuite) TestSessionContext() {
+	const addr = ":9903"
+
+	server := prepareDefaultServer(s.T())
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:    addr,
+		MaxConns:   1,
+		MaxWaiters: 1,
+	})
+	s.Require().NoError(err)
+	noop := func(conn easytcp.IConnection) error { return nil }
+
+	// the only connection is taken
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		client.WithSession(func(conn easytcp.IConnection) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*100)
+	defer cancel()
+	err = client.WithSessionContext(ctx, noop)
+	s.ErrorIs(err, easytcp.ErrPoolTimeout)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	var timeoutErr *easytcp.PoolTimeoutError
+	s.Require().ErrorAs(err, &timeoutErr)
+	s.GreaterOrEqual(timeoutErr.Waited, time.Millisecond*100)
+
+	// the second waiter fails at once
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- client.WithSession(noop)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	s.ErrorIs(client.WithSessionContext(s.ctx, noop), easytcp.ErrPoolQueueFull)
+
+	close(release)
+	s.NoError(<-waiting)
+	s.NoError(client.WithSessionContext(s.ctx, noop))
+}
+
+func (s *ClientTestSuite) TestHealthCheck() {
+	const addr = ":9904"
+
+	// the server echoes every byte and drops the connection on 'x'
+	var connects atomic.Int32
+	startServer := func() context.CancelFunc {
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			b, err := ctx.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == 'x' {
+				return &easytcp.Error{Message: "drop"}
+			}
+			_, err = ctx.SendBinary([]byte{b})
+			return err
+		})
+		server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+			return easytcp.ErrActionClose
+		})
+		server.OnConnect(func(ctx *easytcp.ServerContext) error {
+			connects.Add(1)
+			return nil
+		})
+		listenCtx, stop := context.WithCancel(s.ctx)
+		go func() {
+			server.Listen(listenCtx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+		return stop
+	}
+	echo := func(b byte) func(conn easytcp.IConnection) error {
+		return func(conn easytcp.IConnection) error {
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return err
+			}
+			resp, err := conn.ReadByte()
+			if err != nil {
+				return err
+			}
+			s.Equal(b, resp)
+			return nil
+		}
+	}
+
+	stop := startServer()
+	defer func() { stop() }()
+
+	s.Run("OnBorrow", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:     addr,
+			MaxConns:    1,
+			HealthCheck: easytcp.HealthCheckConfig{OnBorrow: true},
+		})
+		s.Require().NoError(err)
+		s.NoError(client.WithSession(echo('a')))
+
+		// the connection dropped by the server restart is redialed
+		stop()
+		time.Sleep(time.Millisecond * 100)
+		stop = startServer()
+		s.NoError(client.WithSession(echo('b')))
+	})
+
+	s.Run("Discard", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  addr,
+			MaxConns: 1,
+		})
+		s.Require().NoError(err)
+		s.ErrorIs(client.WithSession(echo('x')), io.EOF)
+		s.NoError(client.WithSession(echo('c')))
+	})
+
+	s.Run("Background", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:     addr,
+			MaxConns:    2,
+			MinIdle:     2,
+			HealthCheck: easytcp.HealthCheckConfig{Interval: time.Millisecond * 50},
+		})
+		s.Require().NoError(err)
+
+		stop()
+		time.Sleep(time.Millisecond * 100)
+		connects.Store(0)
+		stop = startServer()
+		// both connections are redialed without any session
+		time.Sleep(time.Millisecond * 200)
+		s.Equal(int32(2), connects.Load())
+		s.NoError(client.WithSession(echo('d')))
+	})
+}
+
+func (s *ClientTestSuite) TestPoolSizing() {
+	const addr = ":9905"
+
+	var connected atomic.Int32
+	startServer := func() {
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			_, err := ctx.ReadByte()
+			return err
+		})
+		server.OnConnect(func(ctx *easytcp.ServerContext) error {
+			connected.Add(1)
+			return nil
+		})
+		server.OnDisconnect(func(ctx *easytcp.ServerContext, reason easytcp.DisconnectReason) {
+			connected.Add(-1)
+		})
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+	}
+	noop := func(conn easytcp.IConnection) error { return nil }
+	// runs n sessions at once, so n connections are dialed
+	sessions := func(client *easytcp.Client, n int) {
+		var wg sync.WaitGroup
+		started := make(chan struct{}, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.NoError(client.WithSession(func(conn easytcp.IConnection) error {
+					started <- struct{}{}
+					for len(started) < n {
+						time.Sleep(time.Millisecond)
+					}
+					return nil
+				}))
+			}()
+		}
+		wg.Wait()
+	}
+
+	// nothing is dialed until the session needs the connection
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 3,
+	})
+	s.Require().NoError(err)
+	s.Error(client.WithSession(noop))
+	startServer()
+	s.Zero(connected.Load())
+	s.NoError(client.WithSession(noop))
+	s.Eventually(func() bool { return connected.Load() == 1 }, time.Second, time.Millisecond*10)
+	s.NoError(client.Close(s.ctx))
+	s.Eventually(func() bool { return connected.Load() == 0 }, time.Second, time.Millisecond*10)
+
+	s.Run("MinIdle", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  addr,
+			MaxConns: 3,
+			MinIdle:  2,
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		s.Eventually(func() bool { return connected.Load() == 2 }, time.Second, time.Millisecond*10)
+	})
+	s.Eventually(func() bool { return connected.Load() == 0 }, time.Second, time.Millisecond*10)
+
+	s.Run("MaxIdleTime", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:     addr,
+			MaxConns:    3,
+			MinIdle:     1,
+			MaxIdleTime: time.Millisecond * 100,
+			HealthCheck: easytcp.HealthCheckConfig{Interval: time.Millisecond * 20},
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		sessions(client, 3)
+		s.Eventually(func() bool { return connected.Load() == 3 }, time.Second, time.Millisecond*10)
+		// the idle connections are closed except the MinIdle one
+		s.Eventually(func() bool { return connected.Load() == 1 }, time.Second, time.Millisecond*10)
+	})
+	s.Eventually(func() bool { return connected.Load() == 0 }, time.Second, time.Millisecond*10)
+
+	s.Run("MaxLifetime", func() {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:     addr,
+			MaxConns:    1,
+			MaxLifetime: time.Millisecond * 100,
+			HealthCheck: easytcp.HealthCheckConfig{Interval: time.Millisecond * 20},
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		first := make(chan easytcp.IConnection, 1)
+		s.NoError(client.WithSession(func(conn easytcp.IConnection) error {
+			first <- conn
+			return nil
+		}))
+		time.Sleep(time.Millisecond * 200)
+		// the expired connection is closed and the next one is dialed
+		s.NoError(client.WithSession(func(conn easytcp.IConnection) error {
+			s.NotSame(<-first, conn)
+			return nil
+		}))
+		s.Eventually(func() bool { return connected.Load() == 1 }, time.Second, time.Millisecond*10)
+	})
+}
+
+func (s *ClientTestSuite) TestClientStats() {
+	const addr = ":9906"
+
+	server := easytcp.NewServer()
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		b := make([]byte, 5)
+		if _, err := ctx.ReadFull(b); err != nil {
+			return err
+		}
+		_, err := ctx.SendBinary(b)
+		return err
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	s.Equal(easytcp.ClientStats{}, client.Stats())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	sessionErr := make(chan error, 1)
+	go func() {
+		sessionErr <- client.WithSession(func(conn easytcp.IConnection) error {
+			close(started)
+			<-release
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				return err
+			}
+			_, err := conn.ReadFull(make([]byte, 5))
+			return err
+		})
+	}()
+	<-started
+	stats := client.Stats()
+	s.Equal(1, stats.TotalConns)
+	s.Equal(1, stats.InUseConns)
+	s.Zero(stats.IdleConns)
+
+	// the next session waits for the first one
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		close(release)
+	}()
+	s.ErrorIs(client.WithSession(func(conn easytcp.IConnection) error {
+		return io.EOF
+	}), io.EOF)
+	s.NoError(<-sessionErr)
+
+	stats = client.Stats()
+	s.Zero(stats.TotalConns)
+	s.Equal(uint64(1), stats.WaitCount)
+	s.GreaterOrEqual(stats.WaitDuration, time.Millisecond*100)
+	s.Equal(uint64(1), stats.Dials)
+	s.Equal(uint64(1), stats.Discarded)
+	s.Equal(uint64(5), stats.BytesRead)
+	s.Equal(uint64(5), stats.BytesWritten)
+
+	s.NoError(client.WithSession(func(conn easytcp.IConnection) error { return nil }))
+	stats = client.Stats()
+	s.Equal(1, stats.TotalConns)
+	s.Equal(1, stats.IdleConns)
+	s.Equal(uint64(2), stats.Dials)
+
+	// nothing listens there
+	unreachable, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  ":9907",
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	s.Error(unreachable.WithSession(func(conn easytcp.IConnection) error { return nil }))
+	s.Equal(uint64(1), unreachable.Stats().DialErrors)
+}
+
+func (s *ClientTestSuite) TestClientStatsRemovedEndpoint() {
+	addrs := []string{":9918", ":9919"}
+
+	var endpoints []easytcp.Endpoint
+	for _, addr := range addrs {
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			b := make([]byte, 5)
+			if _, err := ctx.ReadFull(b); err != nil {
+				return err
+			}
+			_, err := ctx.SendBinary(b)
+			return err
+		})
+		addr := addr
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		endpoints = append(endpoints, easytcp.Endpoint{Address: addr})
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Endpoints: endpoints,
+		MaxConns:  1,
+	})
+	s.Require().NoError(err)
+	defer client.Close(s.ctx)
+
+	// the round robin sends the sessions to both endpoints
+	for range addrs {
+		s.Require().NoError(client.WithSession(func(conn easytcp.IConnection) error {
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				return err
+			}
+			_, err := conn.ReadFull(make([]byte, 5))
+			return err
+		}))
+	}
+	before := client.Stats()
+	s.Equal(2, before.TotalConns)
+	s.Equal(uint64(2), before.Dials)
+	s.Equal(uint64(10), before.BytesWritten)
+
+	// the counters of the removed endpoint are kept, the connections are not
+	s.Require().NoError(client.RemoveEndpoint(s.ctx, addrs[1]))
+	after := client.Stats()
+	s.Equal(1, after.TotalConns)
+	s.Equal(before.Dials, after.Dials)
+	s.Equal(before.BytesRead, after.BytesRead)
+	s.Equal(before.BytesWritten, after.BytesWritten)
+	s.GreaterOrEqual(after.Discarded, before.Discarded)
+}
+
+func (s *ClientTestSuite) TestReconnect() {
+	const addr = ":9908"
+
+	startServer := func() {
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			_, err := ctx.ReadByte()
+			return err
+		})
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+	}
+	noop := func(conn easytcp.IConnection) error { return nil }
+	reconnect := easytcp.ReconnectConfig{
+		InitialBackoff: time.Millisecond * 10,
+		MaxBackoff:     time.Millisecond * 50,
+	}
+
+	failFast, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:   addr,
+		MaxConns:  2,
+		Reconnect: reconnect,
+	})
+	s.Require().NoError(err)
+	defer failFast.Close(s.ctx)
+	reconnect.Wait = true
+	waiting, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:   addr,
+		MaxConns:  2,
+		Reconnect: reconnect,
+	})
+	s.Require().NoError(err)
+	defer waiting.Close(s.ctx)
+
+	// the failed dial starts reconnecting, so the sessions fail fast
+	var opErr *net.OpError
+	err = failFast.WithSession(noop)
+	s.ErrorIs(err, easytcp.ErrReconnecting)
+	s.ErrorAs(err, &opErr)
+	start := time.Now()
+	s.ErrorIs(failFast.WithSession(noop), easytcp.ErrReconnecting)
+	s.Less(time.Since(start), time.Millisecond*100)
+
+	// the waiting sessions are bounded by their context
+	ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*100)
+	defer cancel()
+	s.ErrorIs(waiting.WithSessionContext(ctx, noop), easytcp.ErrPoolTimeout)
+
+	sessionErr := make(chan error, 1)
+	go func() {
+		sessionErr <- waiting.WithSession(noop)
+	}()
+	startServer()
+	s.NoError(<-sessionErr)
+	s.Eventually(func() bool {
+		return failFast.WithSession(noop) == nil
+	}, time.Second, time.Millisecond*10)
+
+	s.Run("MaxAttempts", func() {
+		// nothing listens there
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  ":9907",
+			MaxConns: 1,
+			Reconnect: easytcp.ReconnectConfig{
+				InitialBackoff: time.Millisecond * 10,
+				MaxAttempts:    3,
+				Wait:           true,
+			},
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		// the last dial error is returned once reconnecting gives up
+		err = client.WithSession(noop)
+		s.ErrorAs(err, &opErr)
+		s.NotErrorIs(err, easytcp.ErrReconnecting)
+		s.Equal(uint64(4), client.Stats().DialErrors)
+	})
+}
+
+func (s *ClientTestSuite) TestEndpoints() {
+	addrs := []string{":9909", ":9910", ":9911"}
+	for i, addr := range addrs {
+		// every server replies with its index
+		id, addr := byte(i), addr
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			if _, err := ctx.ReadByte(); err != nil {
+				return err
+			}
+			_, err := ctx.SendBinary([]byte{id})
+			return err
+		})
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	// served runs the session and returns the index of the server, the
+	// session is blocked until hold is closed if it's not nil
+	served := func(client *easytcp.Client, hold chan struct{}) (int, error) {
+		var id int
+		err := client.WithSession(func(conn easytcp.IConnection) error {
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return err
+			}
+			b, err := conn.ReadByte()
+			id = int(b)
+			if hold != nil {
+				<-hold
+			}
+			return err
+		})
+		return id, err
+	}
+	newClient := func(balancer easytcp.Balancer, endpoints ...easytcp.Endpoint) *easytcp.Client {
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Endpoints: endpoints,
+			Balancer:  balancer,
+			MaxConns:  2,
+		})
+		s.Require().NoError(err)
+		return client
+	}
+	a, b := easytcp.Endpoint{Address: addrs[0]}, easytcp.Endpoint{Address: addrs[1]}
+
+	s.Run("RoundRobin", func() {
+		client := newClient(nil, a, b)
+		defer client.Close(s.ctx)
+		for i := 0; i < 4; i++ {
+			id, err := served(client, nil)
+			s.NoError(err)
+			s.Equal(i%2, id)
+		}
+	})
+
+	s.Run("Weighted", func() {
+		client := newClient(easytcp.NewWeightedBalancer(), easytcp.Endpoint{Address: addrs[0], Weight: 3}, b)
+		defer client.Close(s.ctx)
+		var counts [2]int
+		for i := 0; i < 200; i++ {
+			id, err := served(client, nil)
+			s.Require().NoError(err)
+			counts[id]++
+		}
+		s.Greater(counts[0], counts[1]*2)
+		s.NotZero(counts[1])
+	})
+
+	for name, balancer := range map[string]easytcp.Balancer{
+		"LeastOutstanding": easytcp.NewLeastOutstandingBalancer(),
+		"P2C":              easytcp.NewP2CBalancer(),
+	} {
+		balancer := balancer
+		s.Run(name, func() {
+			client := newClient(balancer, a, b)
+			defer client.Close(s.ctx)
+			hold := make(chan struct{})
+			held := make(chan int, 1)
+			go func() {
+				id, err := served(client, hold)
+				s.NoError(err)
+				held <- id
+			}()
+			s.Eventually(func() bool {
+				return client.Stats().InUseConns == 1
+			}, time.Second, time.Millisecond*10)
+			// the next sessions go to the other endpoint
+			for i := 0; i < 3; i++ {
+				id, err := served(client, nil)
+				s.NoError(err)
+				s.Equal(1, client.Endpoints()[1-id].Outstanding())
+			}
+			close(hold)
+			<-held
+		})
+	}
+
+	s.Run("AddRemove", func() {
+		client := newClient(nil, a)
+		defer client.Close(s.ctx)
+		hold := make(chan struct{})
+		sessionErr := make(chan error, 1)
+		go func() {
+			_, err := served(client, hold)
+			sessionErr <- err
+		}()
+		s.Eventually(func() bool {
+			return client.Stats().InUseConns == 1
+		}, time.Second, time.Millisecond*10)
+
+		s.NoError(client.AddEndpoint(b))
+		s.Error(client.AddEndpoint(b))
+		removed := make(chan error, 1)
+		go func() {
+			removed <- client.RemoveEndpoint(s.ctx, a.Address)
+		}()
+		s.Eventually(func() bool {
+			return len(client.Endpoints()) == 1
+		}, time.Second, time.Millisecond*10)
+		for i := 0; i < 2; i++ {
+			id, err := served(client, nil)
+			s.NoError(err)
+			s.Equal(1, id)
+		}
+		// the active session of the removed endpoint is not disturbed
+		select {
+		case <-removed:
+			s.Fail("endpoint is removed before its session completes")
+		default:
+		}
+		close(hold)
+		s.NoError(<-sessionErr)
+		s.NoError(<-removed)
+		s.Error(client.RemoveEndpoint(s.ctx, a.Address))
+	})
+
+	s.Run("Resolver", func() {
+		var resolved atomic.Pointer[[]easytcp.Endpoint]
+		resolved.Store(&[]easytcp.Endpoint{a, b})
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Resolver: func(ctx context.Context) ([]easytcp.Endpoint, error) {
+				return *resolved.Load(), nil
+			},
+			ResolveInterval: time.Millisecond * 20,
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		s.Len(client.Endpoints(), 2)
+
+		resolved.Store(&[]easytcp.Endpoint{b, {Address: addrs[2], Weight: 2}})
+		s.Eventually(func() bool {
+			endpoints := client.Endpoints()
+			return len(endpoints) == 2 && endpoints[0].Address() == addrs[1] &&
+				endpoints[1].Address() == addrs[2] && endpoints[1].Weight() == 2
+		}, time.Second, time.Millisecond*10)
+		ids := map[int]bool{}
+		for i := 0; i < 2; i++ {
+			id, err := served(client, nil)
+			s.NoError(err)
+			ids[id] = true
+		}
+		s.Equal(map[int]bool{1: true, 2: true}, ids)
+
+		resolved.Store(&[]easytcp.Endpoint{})
+		s.Eventually(func() bool {
+			return len(client.Endpoints()) == 0
+		}, time.Second, time.Millisecond*10)
+		_, err = served(client, nil)
+		s.ErrorIs(err, easytcp.ErrNoEndpoints)
+	})
+}
+
+func (s *ClientTestSuite) TestKeySession() {
+	addrs := []string{":9912", ":9913", ":9914"}
+	for i, addr := range addrs {
+		// every server replies with its index
+		id, addr := byte(i), addr
+		server := easytcp.NewServer()
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			if _, err := ctx.ReadByte(); err != nil {
+				return err
+			}
+			_, err := ctx.SendBinary([]byte{id})
+			return err
+		})
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	served := func(client *easytcp.Client, key string) (int, error) {
+		var id int
+		err := client.WithKeySession(key, func(conn easytcp.IConnection) error {
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return err
+			}
+			b, err := conn.ReadByte()
+			id = int(b)
+			return err
+		})
+		return id, err
+	}
+	newClient := func(sharding easytcp.ShardingConfig) *easytcp.Client {
+		var endpoints []easytcp.Endpoint
+		for _, addr := range addrs {
+			endpoints = append(endpoints, easytcp.Endpoint{Address: addr})
+		}
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Endpoints: endpoints,
+			Sharding:  sharding,
+			MaxConns:  4,
+		})
+		s.Require().NoError(err)
+		return client
+	}
+	mapping := func(client *easytcp.Client) map[string]int {
+		shards := make(map[string]int)
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			id, err := served(client, key)
+			s.Require().NoError(err)
+			shards[key] = id
+		}
+		return shards
+	}
+
+	s.Run("Affinity", func() {
+		client := newClient(easytcp.ShardingConfig{})
+		defer client.Close(s.ctx)
+		shards := mapping(client)
+		var counts [3]int
+		for _, id := range shards {
+			counts[id]++
+		}
+		for _, count := range counts {
+			s.Greater(count, 50)
+		}
+		s.Equal(shards, mapping(client))
+	})
+
+	s.Run("Membership", func() {
+		client := newClient(easytcp.ShardingConfig{})
+		defer client.Close(s.ctx)
+		before := mapping(client)
+
+		// only the keys of the removed endpoint are moved
+		s.NoError(client.RemoveEndpoint(s.ctx, addrs[2]))
+		for key, id := range mapping(client) {
+			if before[key] != 2 {
+				s.Equal(before[key], id, key)
+			} else {
+				s.NotEqual(2, id, key)
+			}
+		}
+		s.NoError(client.AddEndpoint(easytcp.Endpoint{Address: addrs[2]}))
+		s.Equal(before, mapping(client))
+	})
+
+	s.Run("BoundedLoad", func() {
+		// holds the sessions of the hot key started one by one
+		hot := func(client *easytcp.Client) map[int]bool {
+			hold := make(chan struct{})
+			ids := make(chan int, 3)
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.NoError(client.WithKeySession("hot", func(conn easytcp.IConnection) error {
+						if _, err := conn.Write([]byte{0}); err != nil {
+							return err
+						}
+						id, err := conn.ReadByte()
+						ids <- int(id)
+						<-hold
+						return err
+					}))
+				}()
+				for len(ids) < i+1 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			close(hold)
+			wg.Wait()
+			close(ids)
+			served := make(map[int]bool)
+			for id := range ids {
+				served[id] = true
+			}
+			return served
+		}
+
+		client := newClient(easytcp.ShardingConfig{})
+		defer client.Close(s.ctx)
+		s.Len(hot(client), 1)
+
+		bounded := newClient(easytcp.ShardingConfig{LoadFactor: 1.25})
+		defer bounded.Close(s.ctx)
+		s.Len(hot(bounded), 2)
+	})
+}
+
+func (s *ClientTestSuite) TestContextIO() {
+	// the peer doesn't read or write anything until told to
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer peer.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := peer.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// interrupted returns the error of the I/O interrupted by the
+	// context and checks that it's interrupted promptly
+	interrupted := func(run func(ctx context.Context) error, cancelAfter, timeout time.Duration) error {
+		ctx, cancel := context.WithCancel(s.ctx)
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(s.ctx, timeout)
+		}
+		defer cancel()
+		if cancelAfter > 0 {
+			time.AfterFunc(cancelAfter, cancel)
+		}
+		start := time.Now()
+		err := run(ctx)
+		s.Less(time.Since(start), time.Second)
+		return err
+	}
+	read := func(conn easytcp.IConnection) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			_, err := conn.ReadContext(ctx, make([]byte, 1))
+			return err
+		}
+	}
+	// the peer doesn't read, so the write blocks once the socket buffers are full
+	write := func(conn easytcp.IConnection) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			_, err := conn.WriteContext(ctx, make([]byte, 64<<20))
+			return err
+		}
+	}
+
+	for _, keepOpen := range []bool{false, true} {
+		keepOpen := keepOpen
+		s.Run(fmt.Sprintf("KeepOpen=%v", keepOpen), func() {
+			client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+				Address:           peer.Addr().String(),
+				MaxConns:          1,
+				KeepOpenOnTimeout: keepOpen,
+			})
+			s.Require().NoError(err)
+			defer client.Close(s.ctx)
+
+			s.NoError(client.WithSession(func(conn easytcp.IConnection) error {
+				server := <-accepted
+				defer server.Close()
+
+				s.ErrorIs(interrupted(read(conn), time.Millisecond*50, 0), context.Canceled)
+				if !keepOpen {
+					_, err := conn.Write([]byte{1})
+					s.ErrorIs(err, net.ErrClosed)
+
+					// the closed connection is usable again once it's redialed
+					s.Require().NoError(conn.Dial())
+					redialed := <-accepted
+					defer redialed.Close()
+					_, err = conn.Write([]byte{1})
+					s.NoError(err)
+					_, err = io.ReadFull(redialed, make([]byte, 1))
+					s.NoError(err)
+					return nil
+				}
+				s.ErrorIs(interrupted(read(conn), 0, time.Millisecond*50), context.DeadlineExceeded)
+
+				// the connection is still usable after the interrupted reads
+				_, err := server.Write([]byte{1})
+				s.Require().NoError(err)
+				b := make([]byte, 1)
+				_, err = conn.ReadContext(s.ctx, b)
+				s.Require().NoError(err)
+				s.Equal(byte(1), b[0])
+
+				s.ErrorIs(interrupted(write(conn), time.Millisecond*50, 0), context.Canceled)
+				s.ErrorIs(interrupted(write(conn), 0, time.Millisecond*50), context.DeadlineExceeded)
+
+				// and after the interrupted writes once the peer reads again
+				go io.Copy(io.Discard, server)
+				_, err = conn.WriteContext(s.ctx, []byte{1})
+				s.NoError(err)
+				return nil
+			}))
+		})
+	}
+}
+
 func TestClientTestSuite(t *testing.T) {
 	suite.Run(t, new(ClientTestSuite))
 }
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ghytro/easytcp/internal/connection"
+)
+
+// tcpPair returns both ends of the loopback tcp connection
+func tcpPair(b *testing.B) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server = <-accepted
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// goroutinePerCallWrite is the way the connection bounded every
+// write with a timeout before: a context, a goroutine and a channel
+// per call, the socket is closed if the timeout expires
+func goroutinePerCallWrite(conn net.Conn, timeout time.Duration, b []byte) (n int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ready := make(chan struct{})
+	go func() {
+		n, err = conn.Write(b)
+		close(ready)
+	}()
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		<-ready
+	case <-ready:
+	}
+	return n, err
+}
+
+// goroutinePerCallRead is the read counterpart of goroutinePerCallWrite
+func goroutinePerCallRead(conn net.Conn, timeout time.Duration, b []byte) (n int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ready := make(chan struct{})
+	go func() {
+		n, err = conn.Read(b)
+		close(ready)
+	}()
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		<-ready
+	case <-ready:
+	}
+	return n, err
+}
+
+func BenchmarkConnectionWrite(b *testing.B) {
+	payload := make([]byte, 64)
+
+	b.Run("Deadline", func(b *testing.B) {
+		client, server := tcpPair(b)
+		go io.Copy(io.Discard, server)
+		conn := connection.NewConnection(context.Background(), client)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("GoroutinePerCall", func(b *testing.B) {
+		client, server := tcpPair(b)
+		go io.Copy(io.Discard, server)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := goroutinePerCallWrite(client, time.Second*10, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkConnectionRead(b *testing.B) {
+	payload := make([]byte, 64)
+
+	// the peer writes the payload every time the previous one is read
+	echoPeer := func(b *testing.B, peer net.Conn) {
+		buf := make([]byte, 1)
+		go func() {
+			for {
+				if _, err := peer.Write(payload); err != nil {
+					return
+				}
+				if _, err := peer.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	b.Run("Deadline", func(b *testing.B) {
+		client, server := tcpPair(b)
+		echoPeer(b, server)
+		conn := connection.NewConnection(context.Background(), client)
+		buf := make([]byte, len(payload))
+		ack := []byte{0}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(ack); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("GoroutinePerCall", func(b *testing.B) {
+		client, server := tcpPair(b)
+		echoPeer(b, server)
+		buf := make([]byte, len(payload))
+		ack := []byte{0}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for read := 0; read < len(buf); {
+				n, err := goroutinePerCallRead(client, time.Second*10, buf[read:])
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+			if _, err := goroutinePerCallWrite(client, time.Second*10, ack); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+)
+
+// stalledListener returns the address the dials to hang on. The listener is
+// never accepted from and its backlog is filled, so the handshakes stall
+func stalledListener(s *ClientTestSuite) (string, func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	s.Require().NoError(err)
+	s.Require().NoError(syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	s.Require().NoError(syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	s.Require().NoError(err)
+	addr := "127.0.0.1:" + strconv.Itoa(sa.(*syscall.SockaddrInet4).Port)
+	filler, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	return addr, func() {
+		filler.Close()
+		syscall.Close(fd)
+	}
+}
+
+func (s *ClientTestSuite) TestDialContext() {
+	addr, stop := stalledListener(s)
+	defer stop()
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:     addr,
+		MaxConns:    1,
+		DialTimeout: time.Second * 10,
+	})
+	s.Require().NoError(err)
+	defer client.Close(s.ctx)
+
+	// the dial is bounded by the session deadline, not by the dial timeout
+	ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	err = client.WithSessionContext(ctx, func(conn easytcp.IConnection) error {
+		return nil
+	})
+	s.ErrorIs(err, easytcp.ErrPoolTimeout)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.Less(time.Since(start), time.Second)
+	// the abandoned dial is not counted as the failed one
+	s.Zero(client.Stats().DialErrors)
+}
@@ -0,0 +1,179 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+	"github.com/Ghytro/easytcp/internal/connection"
+)
+
+const echoSize = 64
+
+// echoServer starts the server that echoes every message of echoSize
+// bytes back. The message is peeked and discarded, so the handler
+// doesn't need a buffer of its own
+func echoServer(b testing.TB, addr string, cfg easytcp.ServerConfig) {
+	startServer(b, addr, cfg, func(ctx *easytcp.ServerContext) error {
+		msg, err := ctx.Peek(echoSize)
+		if err != nil {
+			return err
+		}
+		if _, err := ctx.SendBinary(msg); err != nil {
+			return err
+		}
+		_, err = ctx.Discard(echoSize)
+		return err
+	})
+}
+
+// headerBodyServer starts the server that echoes every message
+// of echoSize bytes back prefixed with the separate header
+func headerBodyServer(b testing.TB, addr string, cfg easytcp.ServerConfig) {
+	header := []byte("head")
+	startServer(b, addr, cfg, func(ctx *easytcp.ServerContext) error {
+		msg, err := ctx.Peek(echoSize)
+		if err != nil {
+			return err
+		}
+		if _, err := ctx.SendBinary(header); err != nil {
+			return err
+		}
+		if _, err := ctx.SendBinary(msg); err != nil {
+			return err
+		}
+		_, err = ctx.Discard(echoSize)
+		return err
+	})
+}
+
+func startServer(b testing.TB, addr string, cfg easytcp.ServerConfig, handler easytcp.ServerHandler) {
+	server := easytcp.NewServer(cfg)
+	server.Register(handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Listen(ctx, addr)
+	}()
+	b.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	time.Sleep(time.Millisecond * 100)
+}
+
+func dialEcho(b testing.TB, addr string) *connection.Connection {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := connection.NewConnection(context.Background(), conn)
+	b.Cleanup(func() { c.Close() })
+	return c
+}
+
+// BenchmarkEcho measures the whole round trip of the echo message. The
+// allocations are counted on both the server and the client side, the
+// hot path of both is expected to allocate nothing
+func BenchmarkEcho(b *testing.B) {
+	payload := make([]byte, echoSize)
+
+	b.Run("Stream", func(b *testing.B) {
+		const addr = ":9888"
+		echoServer(b, addr, easytcp.ServerConfig{})
+		conn := dialEcho(b, addr)
+		buf := make([]byte, echoSize)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.ReadFull(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Framed", func(b *testing.B) {
+		const addr = ":9889"
+		echoServer(b, addr, easytcp.ServerConfig{Framed: true})
+		conn := dialEcho(b, addr)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := conn.WriteFrame(easytcp.Frame{ID: uint64(i), Payload: payload}); err != nil {
+				b.Fatal(err)
+			}
+			f, err := conn.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.ReleaseFrame(f)
+		}
+	})
+}
+
+// TestEchoAllocs fails if the framed echo allocates on the hot path. The
+// allocations are counted process-wide, so the server side is covered too
+func TestEchoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the pooled buffers are dropped at random with the race detector")
+	}
+	const addr = ":9916"
+	echoServer(t, addr, easytcp.ServerConfig{Framed: true})
+	conn := dialEcho(t, addr)
+	payload := make([]byte, echoSize)
+
+	var id uint64
+	allocs := testing.AllocsPerRun(1000, func() {
+		id++
+		if err := conn.WriteFrame(easytcp.Frame{ID: id, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		f, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.ReleaseFrame(f)
+	})
+	if allocs != 0 {
+		t.Fatalf("framed echo allocates %v times per message", allocs)
+	}
+}
+
+// BenchmarkHeaderBody compares the handler sending the header and the
+// body with two writes and with the writes gathered into a single one
+func BenchmarkHeaderBody(b *testing.B) {
+	payload := make([]byte, echoSize)
+
+	run := func(b *testing.B, addr string, batch easytcp.WriteBatchConfig) {
+		headerBodyServer(b, addr, easytcp.ServerConfig{WriteBatch: batch})
+		conn := dialEcho(b, addr)
+		buf := make([]byte, len("head")+echoSize)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.ReadFull(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Unbatched", func(b *testing.B) {
+		run(b, ":9891", easytcp.WriteBatchConfig{})
+	})
+	b.Run("Batched", func(b *testing.B) {
+		run(b, ":9892", easytcp.WriteBatchConfig{MaxSize: 4096})
+	})
+}
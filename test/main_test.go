@@ -12,6 +12,7 @@ import (
 const (
 	stringPayload = "abacaabaca"
 	port          = ":9876"
+	clientPort    = ":9875"
 )
 
 func prepareDefaultServer(t *testing.T) *easytcp.Server {
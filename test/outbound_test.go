@@ -0,0 +1,198 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+)
+
+func (s *ServerTestSuite) TestSendAsync() {
+	const (
+		addr     = ":9893"
+		senders  = 10
+		messages = 20
+	)
+
+	server := easytcp.NewServer()
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		b := make([]byte, 8)
+		if _, err := ctx.ReadFull(b); err != nil {
+			return err
+		}
+		_, err := ctx.SendBinary(b)
+		return err
+	})
+	connected := make(chan *easytcp.ServerContext, 1)
+	server.OnConnect(func(ctx *easytcp.ServerContext) error {
+		connected <- ctx
+		return nil
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer client.Close()
+	ctx := <-connected
+
+	// the messages pushed concurrently with each other and with
+	// the responses of the handler are never interleaved
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				s.NoError(ctx.SendAsync([]byte(fmt.Sprintf("push%02d%02d", i, j)[:8])))
+			}
+		}(i)
+	}
+	for i := 0; i < messages; i++ {
+		_, err := client.Write([]byte(fmt.Sprintf("echo%04d", i)))
+		s.Require().NoError(err)
+	}
+	wg.Wait()
+
+	pushed, echoed := 0, 0
+	b := make([]byte, 8)
+	for pushed+echoed < senders*messages+messages {
+		_, err := io.ReadFull(client, b)
+		s.Require().NoError(err)
+		switch string(b[:4]) {
+		case "push":
+			pushed++
+		case "echo":
+			echoed++
+		default:
+			s.FailNow("the messages are interleaved", string(b))
+		}
+	}
+	s.Equal(senders*messages, pushed)
+	s.Equal(messages, echoed)
+	s.Zero(server.OutboundStats().Depth)
+
+	s.Run("Framed", func() {
+		const addr = ":9917"
+
+		server := easytcp.NewServer(easytcp.ServerConfig{Framed: true})
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			payload, err := io.ReadAll(ctx)
+			if err != nil {
+				return err
+			}
+			return ctx.Send(payload)
+		})
+		connected := make(chan *easytcp.ServerContext, 1)
+		server.OnConnect(func(ctx *easytcp.ServerContext) error {
+			connected <- ctx
+			return nil
+		})
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  addr,
+			MaxConns: 1,
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		s.NoError(client.WithSession(func(conn easytcp.IConnection) error {
+			// the push and the response to the request of zero id are told apart by the flag
+			if err := conn.WriteFrame(easytcp.Frame{Payload: []byte("echo")}); err != nil {
+				return err
+			}
+			s.NoError((<-connected).SendAsync([]byte("push")))
+			pushes := 0
+			for i := 0; i < 2; i++ {
+				f, err := conn.ReadFrame()
+				if err != nil {
+					return err
+				}
+				s.Zero(f.ID)
+				if f.Flags&easytcp.FrameFlagPush != 0 {
+					s.Equal("push", string(f.Payload))
+					pushes++
+				} else {
+					s.Equal("echo", string(f.Payload))
+				}
+			}
+			s.Equal(1, pushes)
+			return nil
+		}))
+	})
+}
+
+func (s *ServerTestSuite) TestSlowConsumer() {
+	tests := []struct {
+		name   string
+		addr   string
+		policy easytcp.SlowConsumerPolicy
+		err    error
+	}{
+		{"DropNewest", ":9894", easytcp.SlowConsumerDropNewest, easytcp.ErrOutboundDropped},
+		{"DropOldest", ":9895", easytcp.SlowConsumerDropOldest, nil},
+		{"Disconnect", ":9896", easytcp.SlowConsumerDisconnect, easytcp.ErrSlowConsumer},
+	}
+	for _, test := range tests {
+		test := test
+		s.Run(test.name, func() {
+			server := easytcp.NewServer(easytcp.ServerConfig{
+				Outbound: easytcp.OutboundConfig{
+					QueueSize: 2,
+					Policy:    test.policy,
+				},
+			})
+			server.Register(func(ctx *easytcp.ServerContext) error { return nil })
+			connected := make(chan *easytcp.ServerContext, 1)
+			server.OnConnect(func(ctx *easytcp.ServerContext) error {
+				connected <- ctx
+				return nil
+			})
+			handled := make(chan error, 1)
+			server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+				handled <- err
+				return easytcp.ErrActionClose
+			})
+			go func() {
+				server.Listen(s.ctx, test.addr)
+			}()
+			time.Sleep(time.Millisecond * 500)
+
+			// the client doesn't read anything, so the writer gets
+			// stuck once the socket buffers are full
+			client, err := net.Dial("tcp", test.addr)
+			s.Require().NoError(err)
+			defer client.Close()
+			ctx := <-connected
+
+			msg := make([]byte, 1<<20)
+			for i := 0; i < 100 && ctx.OutboundStats().Dropped == 0; i++ {
+				if err = ctx.SendAsync(msg); err != nil {
+					break
+				}
+			}
+			if test.err == nil {
+				s.NoError(err)
+				s.NotZero(ctx.OutboundStats().Dropped)
+				s.NotZero(ctx.OutboundStats().Depth)
+				return
+			}
+			s.ErrorIs(err, test.err)
+			if errors.Is(test.err, easytcp.ErrSlowConsumer) {
+				s.ErrorIs(<-handled, easytcp.ErrSlowConsumer)
+				s.ErrorIs(ctx.SendAsync(msg), net.ErrClosed)
+			} else {
+				s.NotZero(server.OutboundStats().Dropped)
+			}
+		})
+	}
+}
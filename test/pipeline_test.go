@@ -0,0 +1,197 @@
+package test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+	"github.com/stretchr/testify/suite"
+)
+
+type PipelineTestSuite struct {
+	suite.Suite
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *PipelineTestSuite) BeforeTest(_, _ string) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+func (s *PipelineTestSuite) AfterTest(_, _ string) {
+	s.cancel()
+}
+
+// startPipelinedServer starts the framed echo server, that
+// handles the "slow" frames longer than the other ones
+func (s *PipelineTestSuite) startPipelinedServer(addr string, order easytcp.ResponseOrder) *easytcp.Client {
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		Framed: true,
+		Pipeline: easytcp.PipelineConfig{
+			MaxInFlight: 4,
+			Order:       order,
+		},
+	})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		payload, err := io.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		if string(payload) == "slow" {
+			time.Sleep(time.Millisecond * 300)
+		}
+		return ctx.Send(payload)
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	return client
+}
+
+func (s *PipelineTestSuite) sendPipelined(client *easytcp.Client) (responses []easytcp.Frame) {
+	err := client.WithSession(func(conn easytcp.IConnection) error {
+		for id, payload := range []string{"slow", "fast", "fast"} {
+			err := conn.WriteFrame(easytcp.Frame{
+				ID:      uint64(id + 1),
+				Payload: []byte(payload),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 3; i++ {
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return err
+			}
+			responses = append(responses, f)
+		}
+		return nil
+	})
+	s.Require().NoError(err)
+	return responses
+}
+
+func (s *PipelineTestSuite) TestRequestOrder() {
+	client := s.startPipelinedServer(":9879", easytcp.ResponseOrderRequest)
+	start := time.Now()
+	responses := s.sendPipelined(client)
+	for i, f := range responses {
+		s.Equal(uint64(i+1), f.ID)
+	}
+	s.Equal("slow", string(responses[0].Payload))
+
+	// fast frames are handled while the slow one is in progress
+	s.Less(time.Since(start), time.Millisecond*600)
+}
+
+func (s *PipelineTestSuite) TestCorrelatedOrder() {
+	client := s.startPipelinedServer(":9880", easytcp.ResponseOrderCorrelated)
+	responses := s.sendPipelined(client)
+	s.Equal(uint64(1), responses[2].ID)
+	s.Equal("slow", string(responses[2].Payload))
+	s.ElementsMatch([]uint64{2, 3}, []uint64{responses[0].ID, responses[1].ID})
+}
+
+func (s *PipelineTestSuite) TestWorkerPool() {
+	const (
+		addr           = ":9884"
+		framesPerConn  = 4
+		handleDuration = time.Millisecond * 50
+	)
+
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		Framed: true,
+		Pipeline: easytcp.PipelineConfig{
+			MaxInFlight: framesPerConn,
+		},
+		WorkerPool: easytcp.WorkerPoolConfig{
+			Size:      1,
+			QueueSize: framesPerConn * 2,
+		},
+	})
+	var (
+		mu                  sync.Mutex
+		running, maxRunning int
+		executionOrder      []string
+	)
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		payload, err := io.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		executionOrder = append(executionOrder, string(payload))
+		mu.Unlock()
+
+		time.Sleep(handleDuration)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return ctx.Send(payload)
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 2,
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"A", "B"} {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.WithSession(func(conn easytcp.IConnection) error {
+				for i := 0; i < framesPerConn; i++ {
+					if err := conn.WriteFrame(easytcp.Frame{ID: uint64(i), Payload: []byte(name)}); err != nil {
+						return err
+					}
+				}
+				for i := 0; i < framesPerConn; i++ {
+					if _, err := conn.ReadFrame(); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			s.NoError(err)
+		}()
+
+		// the frames of B are queued when A already waits for the worker
+		time.Sleep(handleDuration / 2)
+	}
+	wg.Wait()
+
+	s.Equal(1, maxRunning)
+	s.Len(executionOrder, framesPerConn*2)
+
+	// B doesn't wait for all the frames of A to be handled
+	s.Less(strings.Index(strings.Join(executionOrder, ""), "B"), framesPerConn)
+}
+
+func TestPipelineTestSuite(t *testing.T) {
+	suite.Run(t, new(PipelineTestSuite))
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package test
+
+// raceEnabled reports if the tests are built with the race detector,
+// which makes sync.Pool drop the items at random
+const raceEnabled = true
@@ -0,0 +1,102 @@
+//go:build linux
+
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+)
+
+func (s *ServerTestSuite) TestReactor() {
+	const (
+		addr    = ":9887"
+		clients = 200
+	)
+
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		IdleTimeout: time.Millisecond * 1500,
+		Reactor:     true,
+	})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		b := make([]byte, len(stringPayload))
+		if _, err := ctx.ReadFull(b); err != nil {
+			return err
+		}
+		_, err := ctx.SendBinary(b)
+		return err
+	})
+	var idleCalls atomic.Int32
+	server.OnIdle(func(ctx *easytcp.ServerContext) error {
+		idleCalls.Add(1)
+		return errors.New("client is idle for too long")
+	})
+	server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+		return easytcp.ErrActionClose
+	})
+	reasons := make(chan easytcp.DisconnectReason, clients)
+	server.OnDisconnect(func(ctx *easytcp.ServerContext, reason easytcp.DisconnectReason) {
+		reasons <- reason
+	})
+
+	listenCtx, stopListen := context.WithCancel(s.ctx)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.Listen(listenCtx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	goroutines := runtime.NumGoroutine()
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		s.Require().NoError(err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+	time.Sleep(time.Millisecond * 200)
+	// parked connections don't hold the goroutines
+	s.Less(runtime.NumGoroutine()-goroutines, clients/4)
+
+	for round := 0; round < 3; round++ {
+		for _, conn := range conns {
+			_, err := conn.Write([]byte(stringPayload))
+			s.Require().NoError(err)
+		}
+		for _, conn := range conns {
+			b := make([]byte, len(stringPayload))
+			_, err := io.ReadFull(conn, b)
+			s.Require().NoError(err)
+			s.Equal(stringPayload, string(b))
+		}
+	}
+
+	// the closed connections are unregistered
+	for _, conn := range conns[:clients/2] {
+		conn.Close()
+	}
+	for i := 0; i < clients/2; i++ {
+		s.Equal(easytcp.DisconnectClientClosed, <-reasons)
+	}
+
+	// the idle ones are kicked by OnIdle handler
+	for i := 0; i < clients/2; i++ {
+		s.Equal(easytcp.DisconnectTimeout, <-reasons)
+	}
+	s.EqualValues(clients/2, idleCalls.Load())
+
+	// the server shuts down with the parked connection
+	conn, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	stopListen()
+	s.Equal(easytcp.DisconnectServerShutdown, <-reasons)
+	s.ErrorIs(<-listenErr, context.Canceled)
+}
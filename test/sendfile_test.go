@@ -0,0 +1,154 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+)
+
+func (s *ServerTestSuite) TestSendFile() {
+	const (
+		offset = 1000
+		size   = 5 << 20
+	)
+	content := make([]byte, offset+size+1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	path := filepath.Join(s.T().TempDir(), "file")
+	s.Require().NoError(os.WriteFile(path, content, 0o600))
+	f, err := os.Open(path)
+	s.Require().NoError(err)
+	defer f.Close()
+	expected := content[offset : offset+size]
+
+	sendFile := func(ctx *easytcp.ServerContext) error {
+		if _, err := ctx.ReadByte(); err != nil {
+			return err
+		}
+		n, err := ctx.SendFile(f, offset, size)
+		s.Equal(int64(size), n)
+		return err
+	}
+
+	s.Run("Stream", func() {
+		const addr = ":9897"
+		server := easytcp.NewServer()
+		server.Register(sendFile)
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+
+		client, err := net.Dial("tcp", addr)
+		s.Require().NoError(err)
+		defer client.Close()
+		// the file is sent twice, so the offset
+		// of the file is not changed by the first send
+		for i := 0; i < 2; i++ {
+			_, err = client.Write([]byte{0})
+			s.Require().NoError(err)
+			received := make([]byte, size)
+			_, err = io.ReadFull(client, received)
+			s.Require().NoError(err)
+			s.True(bytes.Equal(expected, received))
+		}
+	})
+
+	s.Run("Framed", func() {
+		const addr = ":9898"
+		server := easytcp.NewServer(easytcp.ServerConfig{Framed: true})
+		server.Register(sendFile)
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:      addr,
+			MaxConns:     1,
+			MaxFrameSize: size,
+		})
+		s.Require().NoError(err)
+		err = client.WithSession(func(conn easytcp.IConnection) error {
+			if err := conn.WriteFrame(easytcp.Frame{ID: 1, Payload: []byte{0}}); err != nil {
+				return err
+			}
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return err
+			}
+			s.True(bytes.Equal(expected, f.Payload))
+			return nil
+		})
+		s.NoError(err)
+	})
+}
+
+func (s *ServerTestSuite) TestProxy() {
+	const addr = ":9899"
+
+	// the backend echoes everything back
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	backendClient, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  backend.Addr().String(),
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+
+	proxied := make(chan error, 1)
+	server := easytcp.NewServer()
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		err := backendClient.WithSession(func(conn easytcp.IConnection) error {
+			return ctx.Proxy(conn)
+		})
+		proxied <- err
+		return err
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer client.Close()
+
+	// the first message is read into the buffer of the
+	// server before the proxy starts, so it's piped as well
+	for _, msg := range []string{"first message", "second message"} {
+		_, err = client.Write([]byte(msg))
+		s.Require().NoError(err)
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(client, b)
+		s.Require().NoError(err)
+		s.Equal(msg, string(b))
+	}
+
+	// the proxy is over once the client is gone
+	client.Close()
+	select {
+	case err := <-proxied:
+		s.NoError(err)
+	case <-time.After(time.Second * 5):
+		s.Fail("proxy is not stopped")
+	}
+}
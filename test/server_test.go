@@ -1,11 +1,18 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Ghytro/easytcp"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -50,6 +57,501 @@ func (s *ServerTestSuite) TestBasicPacket() {
 	}
 }
 
+func (s *ServerTestSuite) TestDisconnectAndIdle() {
+	const addr = ":9877"
+
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		ReadTimeout:  time.Second * 2,
+		WriteTimeout: time.Second * 2,
+		IdleTimeout:  time.Millisecond * 300,
+	})
+	afterCalls := make(chan error, 1)
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		ctx.After(func(ctx *easytcp.ServerContext, err error) {
+			afterCalls <- err
+		})
+		return ctx.Next()
+	})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		b := make([]byte, len(stringPayload))
+		if _, err := io.ReadFull(ctx, b); err != nil {
+			return err
+		}
+		_, err := ctx.WriteBuf(b)
+		return err
+	})
+	idleCalls := make(chan struct{}, 1)
+	server.OnIdle(func(ctx *easytcp.ServerContext) error {
+		idleCalls <- struct{}{}
+		return errors.New("client is idle for too long")
+	})
+	server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+		return easytcp.ErrActionClose
+	})
+	reasons := make(chan easytcp.DisconnectReason, 1)
+	server.OnDisconnect(func(ctx *easytcp.ServerContext, reason easytcp.DisconnectReason) {
+		reasons <- reason
+	})
+
+	listenCtx, stopListen := context.WithCancel(s.ctx)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.Listen(listenCtx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	// client closes the connection by itself
+	client, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	_, err = client.Write([]byte(stringPayload))
+	s.NoError(err)
+	b := make([]byte, len(stringPayload))
+	_, err = io.ReadFull(client, b)
+	s.NoError(err)
+	s.NoError(<-afterCalls)
+	s.NoError(client.Close())
+	s.Equal(easytcp.DisconnectClientClosed, <-reasons)
+
+	// the idle client is kicked by OnIdle handler
+	client, err = net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	<-idleCalls
+	s.Equal(easytcp.DisconnectTimeout, <-reasons)
+	client.Close()
+
+	// the server shuts down
+	client, err = net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer client.Close()
+	time.Sleep(time.Millisecond * 100)
+	stopListen()
+	s.Equal(easytcp.DisconnectServerShutdown, <-reasons)
+	s.ErrorIs(<-listenErr, context.Canceled)
+}
+
+func (s *ServerTestSuite) TestMessageContext() {
+	const addr = ":9881"
+
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		Framed:                true,
+		HandlerTimeout:        time.Second * 5,
+		PropagateFrameTimeout: true,
+	})
+	handlerErrs := make(chan error, 1)
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		<-ctx.Context().Done()
+		handlerErrs <- ctx.Context().Err()
+		return ctx.Send(ctx.Context().Err().Error())
+	})
+	listenCtx, stopListen := context.WithCancel(s.ctx)
+	go func() {
+		server.Listen(listenCtx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+
+	// the timeout given by client bounds the message context
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		err := conn.WriteFrame(easytcp.Frame{
+			ID:      1,
+			Timeout: time.Millisecond * 100,
+			Payload: []byte(stringPayload),
+		})
+		if err != nil {
+			return err
+		}
+		f, err := conn.ReadFrame()
+		if err != nil {
+			return err
+		}
+		s.Equal(uint64(1), f.ID)
+		s.Equal(context.DeadlineExceeded.Error(), string(f.Payload))
+		return nil
+	})
+	s.NoError(err)
+	s.ErrorIs(<-handlerErrs, context.DeadlineExceeded)
+
+	// server shutdown reaches the handler
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		return conn.WriteFrame(easytcp.Frame{ID: 2, Payload: []byte(stringPayload)})
+	})
+	s.NoError(err)
+	time.Sleep(time.Millisecond * 100)
+	stopListen()
+	select {
+	case err := <-handlerErrs:
+		s.ErrorIs(err, context.Canceled)
+	case <-time.After(time.Second):
+		s.Fail("handler context is not cancelled on server shutdown")
+	}
+}
+
+func (s *ServerTestSuite) TestErrorFrames() {
+	const addr = ":9882"
+
+	server := easytcp.NewServer(easytcp.ServerConfig{Framed: true})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		payload, err := io.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		switch string(payload) {
+		case "fail":
+			return easytcp.NewError(100, "request failed", []byte("details"))
+		case "drop":
+			return errors.New("request dropped")
+		}
+		return ctx.Send(payload)
+	})
+	server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+		if err.Error() == "request dropped" {
+			return easytcp.ErrActionContinue
+		}
+		return easytcp.DefaultErrorHandler(ctx, err)
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		for id, payload := range []string{"fail", "drop", stringPayload} {
+			err := conn.WriteFrame(easytcp.Frame{ID: uint64(id), Payload: []byte(payload)})
+			if err != nil {
+				return err
+			}
+		}
+
+		// the error is replied and the connection stays open
+		f, err := conn.ReadFrame()
+		var wireErr *easytcp.Error
+		s.Require().ErrorAs(err, &wireErr)
+		s.Equal(uint64(0), f.ID)
+		s.Equal(easytcp.ErrorCode(100), wireErr.Code)
+		s.Equal("request failed", wireErr.Message)
+		s.Equal("details", string(wireErr.Details))
+
+		// the dropped request has no response
+		f, err = conn.ReadFrame()
+		if err != nil {
+			return err
+		}
+		s.Equal(uint64(2), f.ID)
+		s.Equal(stringPayload, string(f.Payload))
+		return nil
+	})
+	s.NoError(err)
+
+	s.Run("Legacy", func() {
+		const addr = ":9915"
+
+		server := easytcp.NewServer(easytcp.ServerConfig{Framed: true})
+		server.Register(func(ctx *easytcp.ServerContext) error {
+			return easytcp.NewError(100, "request failed")
+		})
+		handled := make(chan error, 1)
+		server.ErrorHandler(easytcp.LegacyErrHandler(func(ctx *easytcp.ServerContext, err error) error {
+			handled <- err
+			return nil
+		}))
+		go func() {
+			server.Listen(s.ctx, addr)
+		}()
+		time.Sleep(time.Millisecond * 500)
+
+		client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+			Address:  addr,
+			MaxConns: 1,
+		})
+		s.Require().NoError(err)
+		defer client.Close(s.ctx)
+		// the connection is closed instead of replying with the error
+		err = client.WithSession(func(conn easytcp.IConnection) error {
+			if err := conn.WriteFrame(easytcp.Frame{Payload: []byte(stringPayload)}); err != nil {
+				return err
+			}
+			_, err := conn.ReadFrame()
+			return err
+		})
+		s.ErrorIs(err, io.EOF)
+		var wireErr *easytcp.Error
+		s.ErrorAs(<-handled, &wireErr)
+	})
+}
+
+var (
+	messageCountKey = easytcp.NewKey[int]("message count")
+	payloadKey      = easytcp.NewMessageKey[string]("payload")
+)
+
+func (s *ServerTestSuite) TestTypedKeys() {
+	const addr = ":9883"
+
+	server := easytcp.NewServer(easytcp.ServerConfig{Framed: true})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		_, ok := payloadKey.Get(ctx)
+		s.False(ok, "message-scoped value is visible to another message")
+
+		payload, err := io.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		payloadKey.Set(ctx, string(payload))
+		messageCountKey.Set(ctx, messageCountKey.Value(ctx)+1)
+		return ctx.Next()
+	})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		return ctx.Send(fmt.Sprintf("%s %d", payloadKey.Value(ctx), messageCountKey.Value(ctx)))
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		for i := 1; i <= 3; i++ {
+			if err := conn.WriteFrame(easytcp.Frame{Payload: []byte(stringPayload)}); err != nil {
+				return err
+			}
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return err
+			}
+			s.Equal(fmt.Sprintf("%s %d", stringPayload, i), string(f.Payload))
+		}
+		return nil
+	})
+	s.NoError(err)
+}
+
 func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerTestSuite))
 }
+
+func (s *ServerTestSuite) TestBufferedReader() {
+	const addr = ":9886"
+
+	// every message is a line with the command followed by the body
+	// prefixed with its length, the lines starting with # are skipped
+	server := easytcp.NewServer(easytcp.ServerConfig{ReadBufferSize: 64})
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		first, err := ctx.Peek(1)
+		if err != nil {
+			return err
+		}
+		if first[0] == '#' {
+			_, err := ctx.ReadUntil('\n')
+			return err
+		}
+		cmd, err := ctx.ReadUntil('\n')
+		if err != nil {
+			return err
+		}
+		size, err := ctx.ReadByte()
+		if err != nil {
+			return err
+		}
+		body := make([]byte, size)
+		if _, err := ctx.ReadFull(body); err != nil {
+			return err
+		}
+		_, err = ctx.SendBinary(append(append(bytes.TrimSpace(cmd), ' '), append(body, '\n')...))
+		return err
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		// all the messages arrive in a single packet
+		body := strings.Repeat("x", 100)
+		packet := "#comment\necho\n\x05hellolong\n\x64" + body
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			return err
+		}
+		for _, expected := range []string{"echo hello\n", "long " + body + "\n"} {
+			line, err := conn.ReadUntil('\n')
+			if err != nil {
+				return err
+			}
+			s.Equal(expected, string(line))
+		}
+		return nil
+	})
+	s.NoError(err)
+
+	// the reads failed because of the buffer or the frame size leave the connection open
+	client, err = easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:        addr,
+		MaxConns:       1,
+		ReadBufferSize: 64,
+		MaxFrameSize:   8,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		_, err := conn.Peek(65)
+		s.ErrorIs(err, bufio.ErrBufferFull)
+		_, err = conn.Peek(-1)
+		s.ErrorIs(err, bufio.ErrNegativeCount)
+
+		if _, err := conn.Write([]byte("echo\n\x05hello")); err != nil {
+			return err
+		}
+		line, err := conn.ReadUntil('\n')
+		s.ErrorIs(err, easytcp.ErrTooLong)
+		s.Equal("echo hello\n", string(line))
+
+		if _, err := conn.Write([]byte("echo\n\x02hi")); err != nil {
+			return err
+		}
+		line, err = conn.ReadUntil('\n')
+		if err != nil {
+			return err
+		}
+		s.Equal("echo hi\n", string(line))
+		return nil
+	})
+	s.NoError(err)
+}
+
+func (s *ServerTestSuite) TestWriteBatching() {
+	const addr = ":9890"
+
+	server := easytcp.NewServer(easytcp.ServerConfig{
+		WriteBatch: easytcp.WriteBatchConfig{MaxSize: 1024},
+	})
+	arrived := make(chan string, 1)
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		msg := make([]byte, 4)
+		if _, err := ctx.ReadFull(msg); err != nil {
+			return err
+		}
+		arrived <- string(msg)
+
+		// the header and the body are sent at once
+		// when the handler chain completes
+		if _, err := ctx.SendBinary([]byte("head")); err != nil {
+			return err
+		}
+		if _, err := ctx.SendBinary(msg); err != nil {
+			return err
+		}
+		if string(msg) != "slow" {
+			return nil
+		}
+		// the client gets the response before the chain completes
+		if err := ctx.Flush(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 500)
+		return nil
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:     addr,
+		ReadTimeout: time.Millisecond * 200,
+		WriteBatch: easytcp.WriteBatchConfig{
+			MaxSize:  1024,
+			MaxDelay: time.Millisecond * 50,
+		},
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		// the pending write is flushed before the read
+		if _, err := conn.Write([]byte("fast")); err != nil {
+			return err
+		}
+		resp := make([]byte, 8)
+		if _, err := conn.ReadFull(resp); err != nil {
+			return err
+		}
+		s.Equal("headfast", string(resp))
+		s.Equal("fast", <-arrived)
+
+		// the pending write is flushed once the max delay expires
+		if _, err := conn.Write([]byte("slow")); err != nil {
+			return err
+		}
+		select {
+		case msg := <-arrived:
+			s.Equal("slow", msg)
+		case <-time.After(time.Second):
+			s.Fail("the pending write is not flushed after the max delay")
+		}
+		if _, err := conn.ReadFull(resp); err != nil {
+			return err
+		}
+		s.Equal("headslow", string(resp))
+		return nil
+	})
+	s.NoError(err)
+}
+
+func (s *ServerTestSuite) TestHalfClose() {
+	const addr = ":9901"
+
+	server := easytcp.NewServer()
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		// the request is over once the client half-closes the connection
+		req, err := io.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := ctx.SendBinary(bytes.ToUpper(req)); err != nil {
+			return err
+		}
+		// the queued message is still sent after the client's EOF
+		return ctx.SendAsync([]byte(" done"))
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := easytcp.NewClient(s.ctx, easytcp.ClientConfig{
+		Address:  addr,
+		MaxConns: 1,
+	})
+	s.Require().NoError(err)
+	err = client.WithSession(func(conn easytcp.IConnection) error {
+		if _, err := conn.Write([]byte("request")); err != nil {
+			return err
+		}
+		if err := conn.CloseWrite(); err != nil {
+			return err
+		}
+		resp, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		s.Equal("REQUEST done", string(resp))
+		return nil
+	})
+	s.NoError(err)
+}
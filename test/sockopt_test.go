@@ -0,0 +1,73 @@
+//go:build linux
+
+package test
+
+import (
+	"net"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+)
+
+func (s *ServerTestSuite) TestSocketOptions() {
+	const addr = ":9900"
+
+	opts := easytcp.SocketOptions{
+		Nagle:             true,
+		KeepAliveIdle:     time.Second * 30,
+		KeepAliveInterval: time.Second * 5,
+		KeepAliveCount:    3,
+		UserTimeout:       time.Second * 10,
+		Linger:            time.Second * 2,
+		SendBuffer:        64 << 10,
+		RecvBuffer:        64 << 10,
+		NotSentLowat:      16 << 10,
+		TOS:               46 << 2,
+	}
+	server := easytcp.NewServer(easytcp.ServerConfig{Socket: opts})
+	type result struct {
+		opts easytcp.SocketOptions
+		info easytcp.TCPInfo
+		err  error
+	}
+	results := make(chan result, 1)
+	server.Register(func(ctx *easytcp.ServerContext) error {
+		if _, err := ctx.ReadByte(); err != nil {
+			return err
+		}
+		var r result
+		r.opts, r.err = ctx.SocketOptions()
+		if r.err == nil {
+			r.info, r.err = ctx.TCPInfo()
+		}
+		results <- r
+		return nil
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	client, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer client.Close()
+	_, err = client.Write([]byte{0})
+	s.Require().NoError(err)
+
+	r := <-results
+	s.Require().NoError(r.err)
+	s.True(r.opts.Nagle)
+	s.Equal(opts.KeepAliveIdle, r.opts.KeepAliveIdle)
+	s.Equal(opts.KeepAliveInterval, r.opts.KeepAliveInterval)
+	s.Equal(opts.KeepAliveCount, r.opts.KeepAliveCount)
+	s.Equal(opts.UserTimeout, r.opts.UserTimeout)
+	s.Equal(opts.Linger, r.opts.Linger)
+	// linux doubles the buffer sizes for the bookkeeping
+	s.GreaterOrEqual(r.opts.SendBuffer, opts.SendBuffer)
+	s.GreaterOrEqual(r.opts.RecvBuffer, opts.RecvBuffer)
+	s.Equal(opts.NotSentLowat, r.opts.NotSentLowat)
+	s.Equal(opts.TOS, r.opts.TOS)
+
+	s.Positive(r.info.RTT)
+	s.Positive(r.info.SendMSS)
+}
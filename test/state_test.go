@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ghytro/easytcp"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	stateHandshake easytcp.State = "handshake"
+	stateAuth      easytcp.State = "auth"
+	stateReady     easytcp.State = "ready"
+)
+
+type StateMachineTestSuite struct {
+	suite.Suite
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *StateMachineTestSuite) BeforeTest(_, _ string) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+func (s *StateMachineTestSuite) AfterTest(_, _ string) {
+	s.cancel()
+}
+
+func (s *StateMachineTestSuite) TestTransitions() {
+	const addr = ":9878"
+
+	// every message is a single byte: H - handshake, A - auth, P - ping
+	machine := easytcp.NewStateMachine(stateHandshake, func(ctx *easytcp.ServerContext) (string, error) {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(ctx, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	})
+	machine.State(stateHandshake, easytcp.StateConfig{
+		Handlers: map[string]easytcp.ServerHandler{
+			"H": func(ctx *easytcp.ServerContext) error {
+				return ctx.Transition(stateAuth)
+			},
+		},
+	})
+	machine.State(stateAuth, easytcp.StateConfig{
+		Timeout: time.Millisecond * 300,
+		Handlers: map[string]easytcp.ServerHandler{
+			"A": func(ctx *easytcp.ServerContext) error {
+				return ctx.Transition(stateReady)
+			},
+		},
+	})
+	machine.State(stateReady, easytcp.StateConfig{
+		Handlers: map[string]easytcp.ServerHandler{
+			"P": func(ctx *easytcp.ServerContext) error {
+				return ctx.Send("pong")
+			},
+		},
+	})
+
+	server := easytcp.NewServer()
+	server.StateMachine(machine)
+	errs := make(chan error, 1)
+	server.ErrorHandler(func(ctx *easytcp.ServerContext, err error) easytcp.ErrAction {
+		errs <- err
+		return easytcp.ErrActionClose
+	})
+	states := make(chan easytcp.State, 1)
+	server.OnDisconnect(func(ctx *easytcp.ServerContext, reason easytcp.DisconnectReason) {
+		states <- ctx.State()
+	})
+	go func() {
+		server.Listen(s.ctx, addr)
+	}()
+	time.Sleep(time.Millisecond * 500)
+
+	// the whole protocol passed
+	client, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	_, err = client.Write([]byte("HAP"))
+	s.NoError(err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(client, b)
+	s.NoError(err)
+	s.Equal("pong", string(b))
+	s.NoError(client.Close())
+	s.Equal(stateReady, <-states)
+
+	// ping is not allowed before handshake
+	client, err = net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	_, err = client.Write([]byte("P"))
+	s.NoError(err)
+	s.ErrorIs(<-errs, easytcp.ErrMessageNotAllowed)
+	s.Equal(stateHandshake, <-states)
+	client.Close()
+
+	// authentication is not passed in time
+	client, err = net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer client.Close()
+	_, err = client.Write([]byte("H"))
+	s.NoError(err)
+	s.ErrorIs(<-errs, easytcp.ErrStateTimeout)
+	s.Equal(stateAuth, <-states)
+}
+
+func TestStateMachineTestSuite(t *testing.T) {
+	suite.Run(t, new(StateMachineTestSuite))
+}
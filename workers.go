@@ -0,0 +1,67 @@
+package easytcp
+
+import (
+	"github.com/Ghytro/easytcp/internal/common"
+	"github.com/Ghytro/easytcp/internal/sched"
+)
+
+// WorkerPoolConfig configures the server-wide pool of workers executing
+// the message handlers. Without the pool every connection runs the
+// handlers in its own goroutine with no global limit
+type WorkerPoolConfig struct {
+	// Size is the maximum amount of handler chains running at once.
+	// Zero disables the worker pool
+	Size int
+
+	// QueueSize is the maximum amount of messages waiting for a free worker.
+	// When the queue is full the server stops reading from the sockets, so
+	// the clients are slowed down by the TCP flow control. Defaults to Size
+	QueueSize int
+
+	// Weight tells the share of workers the connection gets. The connections
+	// are served in round-robin order, every connection runs up to its weight
+	// of messages in a row. Called once the OnConnect handler succeeds.
+	// If nil, all the connections have the weight of 1
+	Weight func(ctx *ServerContext) int
+}
+
+// newScheduler creates the scheduler of the worker pool, or returns nil
+// if the pool is disabled
+func (c WorkerPoolConfig) newScheduler() *sched.Scheduler {
+	if c.Size <= 0 {
+		return nil
+	}
+	return sched.New(c.Size, common.Max(c.QueueSize, c.Size))
+}
+
+// joinWorkerPool creates the connection's queue in the worker pool
+func (ctx *ServerContext) joinWorkerPool(workers *sched.Scheduler) {
+	if workers == nil {
+		return
+	}
+	weight := 1
+	if ctx.server.workerPool.Weight != nil {
+		weight = ctx.server.workerPool.Weight(ctx)
+	}
+	ctx.queue = workers.NewQueue(weight)
+}
+
+// execute runs the task in the worker pool and waits until it's done.
+// If the server has no worker pool, the task is run in place
+func (ctx *ServerContext) execute(task func()) error {
+	if ctx.queue == nil {
+		task()
+		return nil
+	}
+	return ctx.queue.Do(task)
+}
+
+// executeAsync runs the task in the worker pool or in the new goroutine
+// if the server has no worker pool. Blocks while the worker pool is full
+func (ctx *ServerContext) executeAsync(task func()) error {
+	if ctx.queue == nil {
+		go task()
+		return nil
+	}
+	return ctx.queue.Submit(task)
+}